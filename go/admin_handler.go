@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+const adminUsernamesEnvKey = "ISUCON13_ADMIN_USERNAMES"
+
+// 管理APIを利用できるユーザ名 (カンマ区切りの環境変数で指定する)
+var adminUsernames = map[string]struct{}{}
+
+func loadAdminUsernames() {
+	v, ok := os.LookupEnv(adminUsernamesEnvKey)
+	if !ok {
+		return
+	}
+	for _, name := range strings.Split(v, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			adminUsernames[name] = struct{}{}
+		}
+	}
+}
+
+// verifyAdminSession はセッションのユーザが管理者であるかを検証する
+func verifyAdminSession(c echo.Context) error {
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	username, _ := sess.Values[defaultUsernameKey].(string)
+	if _, ok := adminUsernames[username]; !ok {
+		return echo.NewHTTPError(http.StatusForbidden, "admin privileges are required")
+	}
+	return nil
+}
+
+type GenerateReservationSlotsRequest struct {
+	// Until までの予約枠を作成する。省略時は予約期間の終わりまで
+	// 予約期間の終わりからローリング期間より先は指定できない
+	Until int64 `json:"until"`
+}
+
+type GenerateReservationSlotsResponse struct {
+	Generated int   `json:"generated"`
+	Until     int64 `json:"until"`
+}
+
+// 予約枠の作成
+// POST /api/admin/reservation_slots/generate
+func generateReservationSlotsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	if err := verifyAdminSession(c); err != nil {
+		return err
+	}
+
+	var req GenerateReservationSlotsRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+
+	now := time.Now()
+	_, until := reservationConf.Term(now)
+	if req.Until > 0 {
+		until = time.Unix(req.Until, 0)
+		if maxUntil := reservationConf.MaxSlotsUntil(now); until.After(maxUntil) {
+			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("until must not be after %d", maxUntil.Unix()))
+		}
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	slots, err := generateReservationSlots(ctx, tx, reservationConf, now, until)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to generate reservation_slots: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+	slotAlloc.add(slots)
+
+	return c.JSON(http.StatusCreated, &GenerateReservationSlotsResponse{
+		Generated: len(slots),
+		Until:     until.Unix(),
+	})
+}
+
+type UpdateReservationSlotsCapacityRequest struct {
+	StartAt int64 `json:"start_at"`
+	EndAt   int64 `json:"end_at"`
+	// 各枠の残数に加える数。負の値で減らす (0 未満にはならない)
+	Delta int64 `json:"delta"`
+}
+
+type UpdateReservationSlotsCapacityResponse struct {
+	Updated int64 `json:"updated"`
+}
+
+// 予約枠の容量変更
+// 容量が増えた場合はキャンセル待ちを予約に切り替える
+// POST /api/admin/reservation_slots/capacity
+func updateReservationSlotsCapacityHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	if err := verifyAdminSession(c); err != nil {
+		return err
+	}
+
+	var req UpdateReservationSlotsCapacityRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+	if req.StartAt >= req.EndAt {
+		return echo.NewHTTPError(http.StatusBadRequest, "start_at must be before end_at")
+	}
+	if req.Delta == 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "delta must not be zero")
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	rs, err := tx.ExecContext(ctx, "UPDATE reservation_slots SET slot = GREATEST(slot + ?, 0) WHERE start_at >= ? AND end_at <= ?", req.Delta, req.StartAt, req.EndAt)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to update reservation_slots: "+err.Error())
+	}
+	updated, err := rs.RowsAffected()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get affected rows: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+	adjustSlots(slotAlloc.slotsIn(req.StartAt, req.EndAt), req.Delta)
+
+	if req.Delta > 0 {
+		if err := processReservationWaitlist(ctx, req.StartAt, req.EndAt); err != nil {
+			c.Logger().Warnf("failed to process reservation waitlist: %v", err)
+		}
+	}
+
+	return c.JSON(http.StatusOK, &UpdateReservationSlotsCapacityResponse{
+		Updated: updated,
+	})
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	defaultBookmarkLimit = 20
+	maxBookmarkLimit     = 100
+)
+
+// bookmarkedLivestreamIDs は閲覧中のユーザがブックマークしているライブ配信のIDを一括で取得する
+// 未ログインの場合は空の集合を返す
+func bookmarkedLivestreamIDs(ctx context.Context, tx *sqlx.Tx, livestreamIDs []int64) (map[int64]struct{}, error) {
+	bookmarked := make(map[int64]struct{})
+	userID, ok := viewerUserID(ctx)
+	if !ok || len(livestreamIDs) == 0 {
+		return bookmarked, nil
+	}
+
+	query, args, err := sqlx.In("SELECT livestream_id FROM bookmarks WHERE user_id = ? AND livestream_id IN (?)", userID, livestreamIDs)
+	if err != nil {
+		return nil, err
+	}
+	var ids []int64
+	if err := tx.SelectContext(ctx, &ids, query, args...); err != nil {
+		return nil, err
+	}
+	for _, id := range ids {
+		bookmarked[id] = struct{}{}
+	}
+	return bookmarked, nil
+}
+
+// ライブ配信のブックマーク
+// POST /api/livestream/:livestream_id/bookmark
+func bookmarkLivestreamHandler(c echo.Context) error {
+	return changeBookmark(c, true)
+}
+
+// ライブ配信のブックマーク解除
+// DELETE /api/livestream/:livestream_id/bookmark
+func unbookmarkLivestreamHandler(c echo.Context) error {
+	return changeBookmark(c, false)
+}
+
+// changeBookmark はセッションユーザのブックマークを作成または削除し、ライブ配信を返す
+// 終了した配信はブックマークできないが、ブックマークの解除はできる
+func changeBookmark(c echo.Context, bookmark bool) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	var livestreamModel LivestreamModel
+	if err := tx.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ?", livestreamID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "livestream not found")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+	}
+
+	now := time.Now().Unix()
+	if bookmark {
+		if livestreamStatus(livestreamModel, now) == livestreamStatusEnded {
+			return echo.NewHTTPError(http.StatusBadRequest, "can't bookmark ended livestream")
+		}
+		if _, err := tx.ExecContext(ctx, "INSERT IGNORE INTO bookmarks (user_id, livestream_id, created_at) VALUES (?, ?, ?)", userID, livestreamModel.ID, now); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert bookmark: "+err.Error())
+		}
+	} else {
+		if _, err := tx.ExecContext(ctx, "DELETE FROM bookmarks WHERE user_id = ? AND livestream_id = ?", userID, livestreamModel.ID); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete bookmark: "+err.Error())
+		}
+	}
+
+	livestream, err := fillLivestreamResponse(ctx, tx, livestreamModel)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestream: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, livestream)
+}
+
+// bookmarkedLivestreamRow はブックマークのIDを付けたライブ配信
+type bookmarkedLivestreamRow struct {
+	LivestreamModel
+	BookmarkID int64 `db:"bookmark_id"`
+}
+
+// ブックマークしたライブ配信一覧 (ブックマークの新しい順)
+// GET /api/user/me/bookmark?limit=20&cursor=
+//
+// 続きがあれば次のページのカーソルを X-Next-Cursor ヘッダで返す
+func getBookmarksHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	limit := defaultBookmarkLimit
+	if c.QueryParam("limit") != "" {
+		l, err := strconv.Atoi(c.QueryParam("limit"))
+		if err != nil || l < 1 || l > maxBookmarkLimit {
+			return echo.NewHTTPError(http.StatusBadRequest, "limit query parameter must be between 1 and "+strconv.Itoa(maxBookmarkLimit))
+		}
+		limit = l
+	}
+
+	query := "SELECT l.*, b.id AS bookmark_id FROM bookmarks b INNER JOIN livestreams l ON l.id = b.livestream_id WHERE b.user_id = ?"
+	args := []interface{}{userID}
+	if c.QueryParam("cursor") != "" {
+		cursor, err := decodeLivestreamSearchCursor(c.QueryParam("cursor"))
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "cursor query parameter is malformed")
+		}
+		query += " AND b.id < ?"
+		args = append(args, cursor.Key)
+	}
+	// 続きがあるかを判定するため1件多く取得する
+	query += fmt.Sprintf(" ORDER BY b.id DESC LIMIT %d", limit+1)
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	var rows []bookmarkedLivestreamRow
+	if err := tx.SelectContext(ctx, &rows, query, args...); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get bookmarks: "+err.Error())
+	}
+	if len(rows) > limit {
+		rows = rows[:limit]
+		last := rows[len(rows)-1]
+		c.Response().Header().Set(nextCursorHeader, livestreamSearchCursor{Key: last.BookmarkID, ID: last.ID}.encode())
+	}
+
+	livestreamModels := make([]LivestreamModel, len(rows))
+	for i, row := range rows {
+		livestreamModels[i] = row.LivestreamModel
+	}
+	livestreams, err := fillLivestreamsResponse(ctx, tx, livestreamModels)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestreams: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, livestreams)
+}
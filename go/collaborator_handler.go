@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	collaboratorStatusPending  = "pending"
+	collaboratorStatusAccepted = "accepted"
+	collaboratorStatusDeclined = "declined"
+
+	notificationKindCollaborationInvited = "collaboration_invited"
+)
+
+type LivestreamCollaboratorModel struct {
+	ID           int64  `db:"id"`
+	LivestreamID int64  `db:"livestream_id"`
+	UserID       int64  `db:"user_id"`
+	Status       string `db:"status"`
+	CreatedAt    int64  `db:"created_at"`
+	UpdatedAt    int64  `db:"updated_at"`
+}
+
+type CollaborationInvitation struct {
+	Livestream Livestream `json:"livestream"`
+	Status     string     `json:"status"`
+	CreatedAt  int64      `json:"created_at"`
+}
+
+// resolveCollaborators は共同配信者のユーザ名をユーザに解決する
+// 存在しないユーザや配信者本人が含まれていれば 400 を返す
+func resolveCollaborators(ctx context.Context, q sqlx.QueryerContext, ownerID int64, usernames []string) ([]UserModel, error) {
+	if len(usernames) == 0 {
+		return nil, nil
+	}
+
+	query, args, err := sqlx.In("SELECT * FROM users WHERE name IN (?)", usernames)
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, "failed to construct IN query: "+err.Error())
+	}
+	var userModels []UserModel
+	if err := sqlx.SelectContext(ctx, q, &userModels, query, args...); err != nil {
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, "failed to get users: "+err.Error())
+	}
+
+	userMap := make(map[string]UserModel, len(userModels))
+	for _, u := range userModels {
+		if u.ID == ownerID {
+			return nil, echo.NewHTTPError(http.StatusBadRequest, "can't invite yourself as a collaborator")
+		}
+		userMap[u.Name] = u
+	}
+	var missing []string
+	for _, name := range usernames {
+		if _, ok := userMap[name]; !ok {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) > 0 {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("collaborators not found: %v", missing))
+	}
+
+	collaborators := make([]UserModel, 0, len(userMap))
+	for _, u := range userMap {
+		collaborators = append(collaborators, u)
+	}
+	return collaborators, nil
+}
+
+// inviteCollaborators はライブ配信に共同配信者を招待し、招待されたユーザに通知する
+func inviteCollaborators(ctx context.Context, tx *sqlx.Tx, livestreamModel LivestreamModel, usernames []string) error {
+	collaborators, err := resolveCollaborators(ctx, tx, livestreamModel.UserID, usernames)
+	if err != nil {
+		return err
+	}
+	if len(collaborators) == 0 {
+		return nil
+	}
+
+	now := time.Now().Unix()
+	models := make([]LivestreamCollaboratorModel, len(collaborators))
+	for i, u := range collaborators {
+		models[i] = LivestreamCollaboratorModel{
+			LivestreamID: livestreamModel.ID,
+			UserID:       u.ID,
+			Status:       collaboratorStatusPending,
+			CreatedAt:    now,
+			UpdatedAt:    now,
+		}
+	}
+	if _, err := tx.NamedExecContext(ctx, "INSERT INTO livestream_collaborators (livestream_id, user_id, status, created_at, updated_at) VALUES (:livestream_id, :user_id, :status, :created_at, :updated_at)", models); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert livestream collaborators: "+err.Error())
+	}
+
+	message := fmt.Sprintf("ライブ配信「%s」の共同配信に招待されました", livestreamModel.Title)
+	for _, u := range collaborators {
+		if err := insertNotification(ctx, tx, u.ID, notificationKindCollaborationInvited, message, livestreamModel.ID); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert notification: "+err.Error())
+		}
+	}
+	return nil
+}
+
+// 共同配信の招待一覧取得API
+// GET /api/user/me/collaboration
+func getCollaborationInvitationsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	status := c.QueryParam("status")
+	if status == "" {
+		status = collaboratorStatusPending
+	}
+	if status != collaboratorStatusPending && status != collaboratorStatusAccepted && status != collaboratorStatusDeclined {
+		return echo.NewHTTPError(http.StatusBadRequest, "status query parameter must be one of pending, accepted, declined")
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	var collaboratorModels []LivestreamCollaboratorModel
+	if err := tx.SelectContext(ctx, &collaboratorModels, "SELECT * FROM livestream_collaborators WHERE user_id = ? AND status = ? ORDER BY id DESC", userID, status); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream collaborators: "+err.Error())
+	}
+
+	invitations := make([]CollaborationInvitation, 0, len(collaboratorModels))
+	if len(collaboratorModels) > 0 {
+		livestreamIDs := make([]int64, len(collaboratorModels))
+		for i, m := range collaboratorModels {
+			livestreamIDs[i] = m.LivestreamID
+		}
+		query, args, err := sqlx.In("SELECT * FROM livestreams WHERE id IN (?)", livestreamIDs)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to construct IN query: "+err.Error())
+		}
+		var livestreamModels []LivestreamModel
+		if err := tx.SelectContext(ctx, &livestreamModels, query, args...); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
+		}
+		livestreams, err := fillLivestreamsResponse(ctx, tx, livestreamModels)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestreams: "+err.Error())
+		}
+		livestreamMap := make(map[int64]Livestream, len(livestreams))
+		for _, l := range livestreams {
+			livestreamMap[l.ID] = l
+		}
+
+		for _, m := range collaboratorModels {
+			livestream, ok := livestreamMap[m.LivestreamID]
+			if !ok {
+				continue
+			}
+			invitations = append(invitations, CollaborationInvitation{
+				Livestream: livestream,
+				Status:     m.Status,
+				CreatedAt:  m.CreatedAt,
+			})
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, invitations)
+}
+
+// 共同配信の招待の承諾API
+// POST /api/livestream/:livestream_id/collaboration/accept
+func acceptCollaborationHandler(c echo.Context) error {
+	return respondCollaboration(c, collaboratorStatusAccepted)
+}
+
+// 共同配信の招待の辞退API
+// POST /api/livestream/:livestream_id/collaboration/decline
+func declineCollaborationHandler(c echo.Context) error {
+	return respondCollaboration(c, collaboratorStatusDeclined)
+}
+
+// respondCollaboration は招待されたユーザ本人の招待の状態を更新する
+// 承諾済みの招待を辞退して共同配信から抜けることもできる
+func respondCollaboration(c echo.Context, status string) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	var collaboratorModel LivestreamCollaboratorModel
+	if err := tx.GetContext(ctx, &collaboratorModel, "SELECT * FROM livestream_collaborators WHERE livestream_id = ? AND user_id = ? FOR UPDATE", livestreamID, userID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "collaboration invitation not found")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream collaborator: "+err.Error())
+	}
+	if collaboratorModel.Status == collaboratorStatusDeclined {
+		return echo.NewHTTPError(http.StatusBadRequest, "collaboration invitation was already declined")
+	}
+
+	if _, err := tx.ExecContext(ctx, "UPDATE livestream_collaborators SET status = ?, updated_at = ? WHERE id = ?", status, time.Now().Unix(), collaboratorModel.ID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to update livestream collaborator: "+err.Error())
+	}
+
+	var livestreamModel LivestreamModel
+	if err := tx.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ?", livestreamID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+	}
+	livestream, err := fillLivestreamResponse(ctx, tx, livestreamModel)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestream: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, CollaborationInvitation{
+		Livestream: livestream,
+		Status:     status,
+		CreatedAt:  collaboratorModel.CreatedAt,
+	})
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	defaultFeedLimit = 20
+	maxFeedLimit     = 100
+)
+
+// followCounts はユーザごとのフォロワー数とフォロー数
+type followCounts struct {
+	followers map[int64]int64
+	following map[int64]int64
+}
+
+// countFollows はユーザごとのフォロワー数とフォロー数を一括で取得する
+func countFollows(ctx context.Context, tx *sqlx.Tx, userIDs []int64) (followCounts, error) {
+	counts := followCounts{
+		followers: make(map[int64]int64, len(userIDs)),
+		following: make(map[int64]int64, len(userIDs)),
+	}
+	if len(userIDs) == 0 {
+		return counts, nil
+	}
+
+	type userCount struct {
+		UserID int64 `db:"user_id"`
+		Count  int64 `db:"count"`
+	}
+	for _, q := range []struct {
+		query string
+		dest  map[int64]int64
+	}{
+		{"SELECT followee_id AS user_id, COUNT(*) AS count FROM follows WHERE followee_id IN (?) GROUP BY followee_id", counts.followers},
+		{"SELECT follower_id AS user_id, COUNT(*) AS count FROM follows WHERE follower_id IN (?) GROUP BY follower_id", counts.following},
+	} {
+		query, args, err := sqlx.In(q.query, userIDs)
+		if err != nil {
+			return followCounts{}, err
+		}
+		var rows []userCount
+		if err := tx.SelectContext(ctx, &rows, query, args...); err != nil {
+			return followCounts{}, err
+		}
+		for _, r := range rows {
+			q.dest[r.UserID] = r.Count
+		}
+	}
+	return counts, nil
+}
+
+// ユーザのフォロー
+// POST /api/user/:username/follow
+func followUserHandler(c echo.Context) error {
+	return changeFollow(c, true)
+}
+
+// ユーザのフォロー解除
+// DELETE /api/user/:username/follow
+func unfollowUserHandler(c echo.Context) error {
+	return changeFollow(c, false)
+}
+
+// changeFollow はセッションユーザから :username へのフォローを作成または削除し、フォロー先のユーザを返す
+// 既にフォローしている場合のフォローと、フォローしていない場合の解除は何もしない
+func changeFollow(c echo.Context, follow bool) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	var followeeModel UserModel
+	if err := tx.GetContext(ctx, &followeeModel, "SELECT * FROM users WHERE name = ?", c.Param("username")); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "not found user that has the given username")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user: "+err.Error())
+	}
+	if followeeModel.ID == userID {
+		return echo.NewHTTPError(http.StatusBadRequest, "can't follow yourself")
+	}
+
+	if follow {
+		if _, err := tx.ExecContext(ctx, "INSERT IGNORE INTO follows (follower_id, followee_id, created_at) VALUES (?, ?, ?)", userID, followeeModel.ID, time.Now().Unix()); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert follow: "+err.Error())
+		}
+	} else {
+		if _, err := tx.ExecContext(ctx, "DELETE FROM follows WHERE follower_id = ? AND followee_id = ?", userID, followeeModel.ID); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete follow: "+err.Error())
+		}
+	}
+
+	followee, err := fillUserResponse(ctx, tx, followeeModel)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill user: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, followee)
+}
+
+// フォローしている配信者の予約中・配信中のライブ配信 (開始の早い順)
+// GET /api/feed?limit=20&cursor=
+//
+// 続きがあれば次のページのカーソルを X-Next-Cursor ヘッダで返す
+func getFeedHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	limit := defaultFeedLimit
+	if c.QueryParam("limit") != "" {
+		l, err := strconv.Atoi(c.QueryParam("limit"))
+		if err != nil || l < 1 || l > maxFeedLimit {
+			return echo.NewHTTPError(http.StatusBadRequest, "limit query parameter must be between 1 and "+strconv.Itoa(maxFeedLimit))
+		}
+		limit = l
+	}
+
+	query := "SELECT l.* FROM livestreams l INNER JOIN follows f ON f.followee_id = l.user_id WHERE f.follower_id = ? AND l.end_at > ?"
+	args := []interface{}{userID, time.Now().Unix()}
+	if c.QueryParam("cursor") != "" {
+		cursor, err := decodeLivestreamSearchCursor(c.QueryParam("cursor"))
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "cursor query parameter is malformed")
+		}
+		query += " AND (l.start_at > ? OR (l.start_at = ? AND l.id > ?))"
+		args = append(args, cursor.Key, cursor.Key, cursor.ID)
+	}
+	// 続きがあるかを判定するため1件多く取得する
+	query += fmt.Sprintf(" ORDER BY l.start_at ASC, l.id ASC LIMIT %d", limit+1)
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	var livestreamModels []LivestreamModel
+	if err := tx.SelectContext(ctx, &livestreamModels, query, args...); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
+	}
+	if len(livestreamModels) > limit {
+		livestreamModels = livestreamModels[:limit]
+		last := livestreamModels[len(livestreamModels)-1]
+		c.Response().Header().Set(nextCursorHeader, livestreamSearchCursor{Key: last.StartAt, ID: last.ID}.encode())
+	}
+
+	livestreams, err := fillLivestreamsResponse(ctx, tx, livestreamModels)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestreams: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, livestreams)
+}
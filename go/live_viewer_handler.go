@@ -0,0 +1,164 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	liveViewerSortJoinedAt = "joined_at"
+	liveViewerSortTip      = "tip"
+)
+
+type LiveViewer struct {
+	User User `json:"user"`
+	// 入室した時刻
+	JoinedAt int64 `json:"joined_at"`
+	// この配信でライブコメントを投稿したか
+	Commented bool `json:"commented"`
+	// この配信でチップを送ったか (返金分を差し引いて正の場合)
+	Tipped   bool  `json:"tipped"`
+	TipTotal int64 `json:"tip_total"`
+}
+
+// 配信中の視聴者一覧 (配信者のみ)
+// GET /api/livestream/:livestream_id/viewer?sort=joined_at|tip
+//
+// joined_at は入室の早い順、tip はチップの合計の多い順 (同額なら入室の早い順) に並べる
+func getLiveViewersHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	sortKey := c.QueryParam("sort")
+	if sortKey == "" {
+		sortKey = liveViewerSortJoinedAt
+	}
+	if sortKey != liveViewerSortJoinedAt && sortKey != liveViewerSortTip {
+		return echo.NewHTTPError(http.StatusBadRequest, "sort query parameter must be one of joined_at, tip")
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	var livestreamModel LivestreamModel
+	if err := tx.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ?", livestreamID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "livestream not found")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+	}
+	if livestreamModel.UserID != userID {
+		return echo.NewHTTPError(http.StatusForbidden, "can't get viewers of other streamer's livestream")
+	}
+
+	viewers := presence.present(livestreamModel.ID, time.Now())
+	liveViewers := []LiveViewer{}
+	if len(viewers) > 0 {
+		viewerIDs := make([]int64, len(viewers))
+		for i, v := range viewers {
+			viewerIDs[i] = v.userID
+		}
+
+		query, args, err := sqlx.In("SELECT DISTINCT user_id FROM livecomments WHERE livestream_id = ? AND user_id IN (?)", livestreamModel.ID, viewerIDs)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to construct IN query: "+err.Error())
+		}
+		var commenterIDs []int64
+		if err := tx.SelectContext(ctx, &commenterIDs, query, args...); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livecomments: "+err.Error())
+		}
+		commented := make(map[int64]struct{}, len(commenterIDs))
+		for _, id := range commenterIDs {
+			commented[id] = struct{}{}
+		}
+
+		query, args, err = sqlx.In("SELECT user_id, SUM(amount) AS tip_total FROM tip_ledger WHERE livestream_id = ? AND user_id IN (?) GROUP BY user_id", livestreamModel.ID, viewerIDs)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to construct IN query: "+err.Error())
+		}
+		var tipTotals []struct {
+			UserID   int64 `db:"user_id"`
+			TipTotal int64 `db:"tip_total"`
+		}
+		if err := tx.SelectContext(ctx, &tipTotals, query, args...); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get tips: "+err.Error())
+		}
+		tipTotalMap := make(map[int64]int64, len(tipTotals))
+		for _, t := range tipTotals {
+			tipTotalMap[t.UserID] = t.TipTotal
+		}
+
+		query, args, err = sqlx.In("SELECT * FROM users WHERE id IN (?)", viewerIDs)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to construct IN query: "+err.Error())
+		}
+		var userModels []UserModel
+		if err := tx.SelectContext(ctx, &userModels, query, args...); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get users: "+err.Error())
+		}
+		users, err := fillUsersResponse(ctx, tx, userModels)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill users: "+err.Error())
+		}
+		userMap := make(map[int64]User, len(users))
+		for _, u := range users {
+			userMap[u.ID] = u
+		}
+
+		for _, v := range viewers {
+			user, ok := userMap[v.userID]
+			if !ok {
+				continue
+			}
+			_, hasCommented := commented[v.userID]
+			tipTotal := tipTotalMap[v.userID]
+			liveViewers = append(liveViewers, LiveViewer{
+				User:      user,
+				JoinedAt:  v.joinedAt.Unix(),
+				Commented: hasCommented,
+				Tipped:    tipTotal > 0,
+				TipTotal:  tipTotal,
+			})
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	sort.Slice(liveViewers, func(i, j int) bool {
+		if sortKey == liveViewerSortTip && liveViewers[i].TipTotal != liveViewers[j].TipTotal {
+			return liveViewers[i].TipTotal > liveViewers[j].TipTotal
+		}
+		if liveViewers[i].JoinedAt != liveViewers[j].JoinedAt {
+			return liveViewers[i].JoinedAt < liveViewers[j].JoinedAt
+		}
+		return liveViewers[i].User.ID < liveViewers[j].User.ID
+	})
+
+	return c.JSON(http.StatusOK, liveViewers)
+}
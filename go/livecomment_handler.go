@@ -56,6 +56,8 @@ type LivecommentReportModel struct {
 
 type ModerateRequest struct {
 	NGWord string `json:"ng_word"`
+	// Refund が true の場合、削除されるライブコメントのチップを投稿者に返金する
+	Refund bool `json:"refund"`
 }
 
 type NGWord struct {
@@ -193,16 +195,12 @@ func postLivecommentHandler(c echo.Context) error {
 	}
 
 	// スパム判定
-	var ngwords []*NGWord
-	if err := tx.SelectContext(ctx, &ngwords, "SELECT id, user_id, livestream_id, word FROM ng_words WHERE user_id = ? AND livestream_id = ?", livestreamModel.UserID, livestreamModel.ID); err != nil && !errors.Is(err, sql.ErrNoRows) {
+	hit, err := hitNGWords(ctx, tx, livestreamModel, req.Comment)
+	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get NG words: "+err.Error())
 	}
-
-	for _, ngword := range ngwords {
-		if strings.Contains(req.Comment, ngword.Word) {
-			// c.Logger().Infof("[hitSpam=%d] comment = %s", hitSpam, req.Comment)
-			return echo.NewHTTPError(http.StatusBadRequest, "このコメントがスパム判定されました")
-		}
+	if hit {
+		return echo.NewHTTPError(http.StatusBadRequest, "このコメントがスパム判定されました")
 	}
 
 	now := time.Now().Unix()
@@ -225,6 +223,10 @@ func postLivecommentHandler(c echo.Context) error {
 	}
 	livecommentModel.ID = livecommentID
 
+	if err := recordTip(ctx, tx, livecommentModel); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to record tip: "+err.Error())
+	}
+
 	livecomment, err := fillLivecommentResponse(ctx, tx, livecommentModel)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livecomment: "+err.Error())
@@ -234,6 +236,8 @@ func postLivecommentHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
 	}
 
+	trending.recordLivecomment(livecommentModel.LivestreamID, livecommentModel.Tip, time.Unix(now, 0))
+
 	return c.JSON(http.StatusCreated, livecomment)
 }
 
@@ -370,6 +374,21 @@ func moderateHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get NG words: "+err.Error())
 	}
 
+	// 削除されるチップ付きの投稿を返金する
+	if req.Refund {
+		var tippedLivecomments []*LivecommentModel
+		for _, ngword := range ngwords {
+			var hits []*LivecommentModel
+			if err := tx.SelectContext(ctx, &hits, "SELECT * FROM livecomments WHERE livestream_id = ? AND tip > 0 AND comment LIKE CONCAT('%', ?, '%')", livestreamID, ngword.Word); err != nil {
+				return echo.NewHTTPError(http.StatusInternalServerError, "failed to get tipped livecomments: "+err.Error())
+			}
+			tippedLivecomments = append(tippedLivecomments, hits...)
+		}
+		if err := refundTips(ctx, tx, uniqueLivecomments(tippedLivecomments)); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to refund tips: "+err.Error())
+		}
+	}
+
 	// NGワードにヒットする過去の投稿も全削除する
 	for _, ngword := range ngwords {
 		// ライブコメント一覧取得
@@ -406,6 +425,112 @@ func moderateHandler(c echo.Context) error {
 	})
 }
 
+// hitNGWords はコメントが配信者の登録したNGワードを含むかを判定する
+func hitNGWords(ctx context.Context, tx *sqlx.Tx, livestreamModel LivestreamModel, comment string) (bool, error) {
+	var ngwords []*NGWord
+	if err := tx.SelectContext(ctx, &ngwords, "SELECT id, user_id, livestream_id, word FROM ng_words WHERE user_id = ? AND livestream_id = ?", livestreamModel.UserID, livestreamModel.ID); err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return false, err
+	}
+
+	for _, ngword := range ngwords {
+		if strings.Contains(comment, ngword.Word) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// 配信者によるライブコメント削除
+// DELETE /api/livestream/:livestream_id/livecomment/:livecomment_id?refund=true
+func deleteLivecommentHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	livecommentID, err := strconv.Atoi(c.Param("livecomment_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livecomment_id in path must be integer")
+	}
+
+	refund := false
+	if c.QueryParam("refund") != "" {
+		refund, err = strconv.ParseBool(c.QueryParam("refund"))
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "refund query parameter must be boolean")
+		}
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	var livestreamModel LivestreamModel
+	if err := tx.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ?", livestreamID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "livestream not found")
+		} else {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+		}
+	}
+
+	if livestreamModel.UserID != userID {
+		return echo.NewHTTPError(http.StatusForbidden, "can't delete livecomments of other streamer's livestream")
+	}
+
+	var livecommentModel LivecommentModel
+	if err := tx.GetContext(ctx, &livecommentModel, "SELECT * FROM livecomments WHERE id = ? AND livestream_id = ? FOR UPDATE", livecommentID, livestreamID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "livecomment not found")
+		} else {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livecomment: "+err.Error())
+		}
+	}
+
+	if refund {
+		if err := refundTips(ctx, tx, []*LivecommentModel{&livecommentModel}); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to refund tip: "+err.Error())
+		}
+	}
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM livecomments WHERE id = ?", livecommentID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete livecomment: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// uniqueLivecomments は複数のNGワードにヒットした重複を取り除く
+func uniqueLivecomments(livecomments []*LivecommentModel) []*LivecommentModel {
+	seen := make(map[int64]struct{}, len(livecomments))
+	unique := make([]*LivecommentModel, 0, len(livecomments))
+	for _, lc := range livecomments {
+		if _, ok := seen[lc.ID]; ok {
+			continue
+		}
+		seen[lc.ID] = struct{}{}
+		unique = append(unique, lc)
+	}
+	return unique
+}
+
 func fillLivecommentResponse(ctx context.Context, tx *sqlx.Tx, livecommentModel LivecommentModel) (Livecomment, error) {
 	livecomments, err := fillLivecommentsResponse(ctx, tx, []LivecommentModel{livecommentModel})
 	if err != nil {
@@ -7,6 +7,7 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"sort"
 	"strconv"
 	"time"
 
@@ -23,12 +24,16 @@ type ReserveLivestreamRequest struct {
 	ThumbnailUrl string  `json:"thumbnail_url"`
 	StartAt      int64   `json:"start_at"`
 	EndAt        int64   `json:"end_at"`
+	// 共同配信者として招待するユーザ名
+	Collaborators []string `json:"collaborators"`
 }
 
 type LivestreamViewerModel struct {
 	UserID       int64 `db:"user_id" json:"user_id"`
 	LivestreamID int64 `db:"livestream_id" json:"livestream_id"`
 	CreatedAt    int64 `db:"created_at" json:"created_at"`
+	// 退室した時刻 (視聴中は 0)
+	ExitedAt int64 `db:"exited_at" json:"exited_at"`
 }
 
 type LivestreamModel struct {
@@ -40,6 +45,8 @@ type LivestreamModel struct {
 	ThumbnailUrl string `db:"thumbnail_url" json:"thumbnail_url"`
 	StartAt      int64  `db:"start_at" json:"start_at"`
 	EndAt        int64  `db:"end_at" json:"end_at"`
+	// 最大同時視聴者数
+	PeakViewers int64 `db:"peak_viewers" json:"peak_viewers"`
 }
 
 type Livestream struct {
@@ -52,6 +59,43 @@ type Livestream struct {
 	Tags         []Tag  `json:"tags"`
 	StartAt      int64  `json:"start_at"`
 	EndAt        int64  `json:"end_at"`
+	// 招待を承諾した共同配信者
+	Collaborators []User `json:"collaborators"`
+	// scheduled, live, ended
+	Status string `json:"status"`
+	// 閲覧中のユーザがブックマークしているか
+	IsBookmarked bool `json:"is_bookmarked"`
+}
+
+const (
+	livestreamStatusScheduled = "scheduled"
+	livestreamStatusLive      = "live"
+	livestreamStatusEnded     = "ended"
+)
+
+// livestreamStatus は現在時刻における配信の状態を返す
+func livestreamStatus(livestreamModel LivestreamModel, now int64) string {
+	switch {
+	case now < livestreamModel.StartAt:
+		return livestreamStatusScheduled
+	case now < livestreamModel.EndAt:
+		return livestreamStatusLive
+	default:
+		return livestreamStatusEnded
+	}
+}
+
+// livestreamStatusCondition は配信の状態で絞り込む WHERE 句の条件を返す
+func livestreamStatusCondition(status string, now int64) (string, []interface{}, error) {
+	switch status {
+	case livestreamStatusScheduled:
+		return "start_at > ?", []interface{}{now}, nil
+	case livestreamStatusLive:
+		return "start_at <= ? AND end_at > ?", []interface{}{now, now}, nil
+	case livestreamStatusEnded:
+		return "end_at <= ?", []interface{}{now}, nil
+	}
+	return "", nil, echo.NewHTTPError(http.StatusBadRequest, "status query parameter must be one of scheduled, live, ended")
 }
 
 type LivestreamTagModel struct {
@@ -81,84 +125,318 @@ func reserveLivestreamHandler(c echo.Context) error {
 	// existence already checked
 	userID := sess.Values[defaultUserIDKey].(int64)
 
+	// dry_run=true の場合は予約できるかどうかの見積もりのみを返す
+	dryRun := false
+	if v := c.QueryParam("dry_run"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "dry_run query parameter must be a boolean")
+		}
+		dryRun = b
+	}
+
 	var req *ReserveLivestreamRequest
 	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
 		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
 	}
 
+	if dryRun {
+		quote, err := quoteReservation(ctx, userID, req)
+		if err != nil {
+			return err
+		}
+		return c.JSON(http.StatusOK, quote)
+	}
+
 	tx, err := dbConn.BeginTxx(ctx, nil)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
 	}
 	defer tx.Rollback()
 
-	// 2023/11/25 10:00からの１年間の期間内であるかチェック
+	if err := validateReservationTerm(req.StartAt, req.EndAt); err != nil {
+		return err
+	}
+
+	if err := validateTagIDs(ctx, tx, req.Tags); err != nil {
+		return err
+	}
+
+	// 予約ポリシー (予約数の上限、配信の長さなど) を満たすか調べる
+	if err := lockUserForReservation(ctx, tx, userID); err != nil {
+		return err
+	}
+	if err := checkReservationPolicy(ctx, tx, userID, []reservationRange{{startAt: req.StartAt, endAt: req.EndAt}}, time.Now()); err != nil {
+		return err
+	}
+
+	// 予約枠をみて、予約が可能か調べる
+	sr := newSlotReservation()
+	defer sr.Rollback()
+	if err := acquireReservationSlots(ctx, tx, sr, req.StartAt, req.EndAt); err != nil {
+		return err
+	}
+
+	livestreamModel, err := insertReservedLivestream(ctx, tx, userID, req)
+	if err != nil {
+		return err
+	}
+
+	livestream, err := fillLivestreamResponse(ctx, tx, livestreamModel)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestream: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+	sr.Commit()
+
+	return c.JSON(http.StatusCreated, livestream)
+}
+
+// validateReservationTerm は予約区間が予約期間と重なっているかをチェックする
+func validateReservationTerm(startAt, endAt int64) error {
+	// 設定された予約期間内であるかチェック (デフォルトは2023/11/25 10:00からの１年間)
 	var (
-		termStartAt    = time.Date(2023, 11, 25, 1, 0, 0, 0, time.UTC)
-		termEndAt      = time.Date(2024, 11, 25, 1, 0, 0, 0, time.UTC)
-		reserveStartAt = time.Unix(req.StartAt, 0)
-		reserveEndAt   = time.Unix(req.EndAt, 0)
+		termStartAt, termEndAt = reservationConf.Term(time.Now())
+		reserveStartAt         = time.Unix(startAt, 0)
+		reserveEndAt           = time.Unix(endAt, 0)
 	)
 	if (reserveStartAt.Equal(termEndAt) || reserveStartAt.After(termEndAt)) || (reserveEndAt.Equal(termStartAt) || reserveEndAt.Before(termStartAt)) {
 		return echo.NewHTTPError(http.StatusBadRequest, "bad reservation time range")
 	}
+	return nil
+}
 
-	// 予約枠をみて、予約が可能か調べる
-	// NOTE: 並列な予約のoverbooking防止にFOR UPDATEが必要
-	var slots []*ReservationSlotModel
-	if err := tx.SelectContext(ctx, &slots, "SELECT * FROM reservation_slots WHERE start_at >= ? AND end_at <= ? FOR UPDATE", req.StartAt, req.EndAt); err != nil {
-		c.Logger().Warnf("予約枠一覧取得でエラー発生: %+v", err)
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get reservation_slots: "+err.Error())
+// acquireReservationSlots は予約区間に含まれる予約枠を1つずつ消費する
+// 残数の判定はメモリ上のアロケータで行い、テーブルは slot > 0 の条件付きで減算して永続化する
+func acquireReservationSlots(ctx context.Context, tx *sqlx.Tx, sr *slotReservation, startAt, endAt int64) error {
+	if !sr.acquire(startAt, endAt) {
+		return reservationUnavailableError(startAt, endAt)
 	}
-	for _, slot := range slots {
-		var count int
-		if err := tx.GetContext(ctx, &count, "SELECT slot FROM reservation_slots WHERE start_at = ? AND end_at = ?", slot.StartAt, slot.EndAt); err != nil {
-			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get reservation_slots: "+err.Error())
-		}
-		c.Logger().Infof("%d ~ %d予約枠の残数 = %d\n", slot.StartAt, slot.EndAt, slot.Slot)
-		if count < 1 {
-			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("予約期間 %d ~ %dに対して、予約区間 %d ~ %dが予約できません", termStartAt.Unix(), termEndAt.Unix(), req.StartAt, req.EndAt))
-		}
+	return acquireReservationSlotsInDB(ctx, tx, startAt, endAt)
+}
+
+// releaseReservationSlots は予約区間に含まれる予約枠を1つずつ返却する
+func releaseReservationSlots(ctx context.Context, tx *sqlx.Tx, sr *slotReservation, startAt, endAt int64) error {
+	sr.release(startAt, endAt)
+	return releaseReservationSlotsInDB(ctx, tx, startAt, endAt)
+}
+
+// rescheduleReservationSlots は旧区間の予約枠を返却し、新区間の予約枠を消費する
+func rescheduleReservationSlots(ctx context.Context, tx *sqlx.Tx, sr *slotReservation, oldStartAt, oldEndAt, newStartAt, newEndAt int64) error {
+	if !sr.reschedule(oldStartAt, oldEndAt, newStartAt, newEndAt) {
+		return reservationUnavailableError(newStartAt, newEndAt)
 	}
+	if err := releaseReservationSlotsInDB(ctx, tx, oldStartAt, oldEndAt); err != nil {
+		return err
+	}
+	return acquireReservationSlotsInDB(ctx, tx, newStartAt, newEndAt)
+}
 
-	var (
-		livestreamModel = &LivestreamModel{
-			UserID:       int64(userID),
-			Title:        req.Title,
-			Description:  req.Description,
-			PlaylistUrl:  req.PlaylistUrl,
-			ThumbnailUrl: req.ThumbnailUrl,
-			StartAt:      req.StartAt,
-			EndAt:        req.EndAt,
-		}
-	)
+func acquireReservationSlotsInDB(ctx context.Context, tx *sqlx.Tx, startAt, endAt int64) error {
+	var total int64
+	if err := tx.GetContext(ctx, &total, "SELECT COUNT(*) FROM reservation_slots WHERE start_at >= ? AND end_at <= ?", startAt, endAt); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get reservation_slots: "+err.Error())
+	}
+
+	// 別プロセスとの競合などでメモリ上の残数とずれていても overbooking しないよう、残数のある枠だけを減算する
+	rs, err := tx.ExecContext(ctx, "UPDATE reservation_slots SET slot = slot - 1 WHERE start_at >= ? AND end_at <= ? AND slot > 0", startAt, endAt)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to update reservation_slot: "+err.Error())
+	}
+	updated, err := rs.RowsAffected()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get affected rows: "+err.Error())
+	}
+	if updated != total {
+		return reservationUnavailableError(startAt, endAt)
+	}
+	return nil
+}
 
-	if _, err := tx.ExecContext(ctx, "UPDATE reservation_slots SET slot = slot - 1 WHERE start_at >= ? AND end_at <= ?", req.StartAt, req.EndAt); err != nil {
+func releaseReservationSlotsInDB(ctx context.Context, tx *sqlx.Tx, startAt, endAt int64) error {
+	if _, err := tx.ExecContext(ctx, "UPDATE reservation_slots SET slot = slot + 1 WHERE start_at >= ? AND end_at <= ?", startAt, endAt); err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to update reservation_slot: "+err.Error())
 	}
+	return nil
+}
+
+// errReservationUnavailable は予約枠が足りずに予約できないことを表す
+var errReservationUnavailable = errors.New("reservation slots are unavailable")
+
+func reservationUnavailableError(startAt, endAt int64) error {
+	termStartAt, termEndAt := reservationConf.Term(time.Now())
+	return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("予約期間 %d ~ %dに対して、予約区間 %d ~ %dが予約できません", termStartAt.Unix(), termEndAt.Unix(), startAt, endAt)).SetInternal(errReservationUnavailable)
+}
+
+// isReservationUnavailable は予約枠が足りずに予約できなかったエラーかを判定する
+func isReservationUnavailable(err error) bool {
+	return errors.Is(err, errReservationUnavailable)
+}
+
+// insertReservedLivestream は予約枠を確保済みの予約リクエストからライブ配信とタグを作成する
+func insertReservedLivestream(ctx context.Context, tx *sqlx.Tx, userID int64, req *ReserveLivestreamRequest) (LivestreamModel, error) {
+	livestreamModel := LivestreamModel{
+		UserID:       userID,
+		Title:        req.Title,
+		Description:  req.Description,
+		PlaylistUrl:  req.PlaylistUrl,
+		ThumbnailUrl: req.ThumbnailUrl,
+		StartAt:      req.StartAt,
+		EndAt:        req.EndAt,
+	}
 
 	rs, err := tx.NamedExecContext(ctx, "INSERT INTO livestreams (user_id, title, description, playlist_url, thumbnail_url, start_at, end_at) VALUES(:user_id, :title, :description, :playlist_url, :thumbnail_url, :start_at, :end_at)", livestreamModel)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert livestream: "+err.Error())
+		return LivestreamModel{}, echo.NewHTTPError(http.StatusInternalServerError, "failed to insert livestream: "+err.Error())
 	}
 
 	livestreamID, err := rs.LastInsertId()
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get last inserted livestream id: "+err.Error())
+		return LivestreamModel{}, echo.NewHTTPError(http.StatusInternalServerError, "failed to get last inserted livestream id: "+err.Error())
 	}
 	livestreamModel.ID = livestreamID
 
 	// タグ追加
-	for _, tagID := range req.Tags {
-		if _, err := tx.NamedExecContext(ctx, "INSERT INTO livestream_tags (livestream_id, tag_id) VALUES (:livestream_id, :tag_id)", &LivestreamTagModel{
+	if err := insertLivestreamTags(ctx, tx, livestreamID, req.Tags); err != nil {
+		return LivestreamModel{}, echo.NewHTTPError(http.StatusInternalServerError, "failed to insert livestream tag: "+err.Error())
+	}
+
+	// 共同配信者の招待
+	if err := inviteCollaborators(ctx, tx, livestreamModel, req.Collaborators); err != nil {
+		return LivestreamModel{}, err
+	}
+
+	return livestreamModel, nil
+}
+
+// insertLivestreamTags はライブ配信にタグを一括で付与する
+func insertLivestreamTags(ctx context.Context, tx *sqlx.Tx, livestreamID int64, tagIDs []int64) error {
+	if len(tagIDs) == 0 {
+		return nil
+	}
+	livestreamTags := make([]LivestreamTagModel, len(tagIDs))
+	for i, tagID := range tagIDs {
+		livestreamTags[i] = LivestreamTagModel{
 			LivestreamID: livestreamID,
 			TagID:        tagID,
-		}); err != nil {
-			return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert livestream tag: "+err.Error())
 		}
 	}
+	_, err := tx.NamedExecContext(ctx, "INSERT INTO livestream_tags (livestream_id, tag_id) VALUES (:livestream_id, :tag_id)", livestreamTags)
+	return err
+}
+
+type UpdateLivestreamRequest struct {
+	Tags         *[]int64 `json:"tags"`
+	Title        *string  `json:"title"`
+	Description  *string  `json:"description"`
+	PlaylistUrl  *string  `json:"playlist_url"`
+	ThumbnailUrl *string  `json:"thumbnail_url"`
+	StartAt      *int64   `json:"start_at"`
+	EndAt        *int64   `json:"end_at"`
+}
+
+// 予約済みライブ配信の編集 (リスケジュール時は予約枠を付け替える)
+// PATCH /api/livestream/:livestream_id
+func updateLivestreamHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
 
-	livestream, err := fillLivestreamResponse(ctx, tx, *livestreamModel)
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	var req *UpdateLivestreamRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	livestreamModel, err := getOwnedLivestreamForUpdate(ctx, tx, int64(livestreamID), userID)
+	if err != nil {
+		return err
+	}
+	// 開始済みの配信は予約済みの配信として扱わない
+	if livestreamModel.StartAt <= time.Now().Unix() {
+		return echo.NewHTTPError(http.StatusBadRequest, "can't update livestream that has already started")
+	}
+	oldStartAt, oldEndAt := livestreamModel.StartAt, livestreamModel.EndAt
+
+	sr := newSlotReservation()
+	defer sr.Rollback()
+	if req.StartAt != nil || req.EndAt != nil {
+		startAt, endAt := livestreamModel.StartAt, livestreamModel.EndAt
+		if req.StartAt != nil {
+			startAt = *req.StartAt
+		}
+		if req.EndAt != nil {
+			endAt = *req.EndAt
+		}
+		if startAt >= endAt {
+			return echo.NewHTTPError(http.StatusBadRequest, "start_at must be before end_at")
+		}
+
+		if startAt != livestreamModel.StartAt || endAt != livestreamModel.EndAt {
+			if err := validateReservationTerm(startAt, endAt); err != nil {
+				return err
+			}
+			if err := checkReschedulePolicy([]reservationRange{{startAt: startAt, endAt: endAt}}, time.Now()); err != nil {
+				return err
+			}
+			// 旧区間の枠を返却して新区間の枠を確保する。失敗した場合はロールバックで元に戻る
+			if err := rescheduleReservationSlots(ctx, tx, sr, livestreamModel.StartAt, livestreamModel.EndAt, startAt, endAt); err != nil {
+				return err
+			}
+			livestreamModel.StartAt = startAt
+			livestreamModel.EndAt = endAt
+		}
+	}
+	if req.Title != nil {
+		livestreamModel.Title = *req.Title
+	}
+	if req.Description != nil {
+		livestreamModel.Description = *req.Description
+	}
+	if req.PlaylistUrl != nil {
+		livestreamModel.PlaylistUrl = *req.PlaylistUrl
+	}
+	if req.ThumbnailUrl != nil {
+		livestreamModel.ThumbnailUrl = *req.ThumbnailUrl
+	}
+
+	if _, err := tx.NamedExecContext(ctx, "UPDATE livestreams SET title = :title, description = :description, playlist_url = :playlist_url, thumbnail_url = :thumbnail_url, start_at = :start_at, end_at = :end_at WHERE id = :id", livestreamModel); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to update livestream: "+err.Error())
+	}
+
+	// タグは PUT /api/livestream/:livestream_id/tag と同じく置き換える
+	if req.Tags != nil {
+		tagIDs := uniqueTagIDs(*req.Tags)
+		if err := validateTagIDs(ctx, tx, tagIDs); err != nil {
+			return err
+		}
+		if err := replaceLivestreamTags(ctx, tx, livestreamModel.ID, tagIDs); err != nil {
+			return err
+		}
+	}
+
+	livestream, err := fillLivestreamResponse(ctx, tx, livestreamModel)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestream: "+err.Error())
 	}
@@ -166,13 +444,36 @@ func reserveLivestreamHandler(c echo.Context) error {
 	if err := tx.Commit(); err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
 	}
+	sr.Commit()
 
-	return c.JSON(http.StatusCreated, livestream)
+	// 旧区間で空いた枠をキャンセル待ちに回す
+	if livestreamModel.StartAt != oldStartAt || livestreamModel.EndAt != oldEndAt {
+		if err := processReservationWaitlist(ctx, oldStartAt, oldEndAt); err != nil {
+			c.Logger().Warnf("failed to process reservation waitlist: %v", err)
+		}
+	}
+
+	return c.JSON(http.StatusOK, livestream)
 }
 
-func searchLivestreamsHandler(c echo.Context) error {
+// 予約済みライブ配信のキャンセル (予約枠を返却する)
+// DELETE /api/livestream/:livestream_id
+func cancelLivestreamHandler(c echo.Context) error {
 	ctx := c.Request().Context()
-	keyTagName := c.QueryParam("tag")
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
 
 	tx, err := dbConn.BeginTxx(ctx, nil)
 	if err != nil {
@@ -180,62 +481,135 @@ func searchLivestreamsHandler(c echo.Context) error {
 	}
 	defer tx.Rollback()
 
-	var livestreamModels []*LivestreamModel
-	if c.QueryParam("tag") != "" {
-		// タグによる取得
-		var tagIDList []int
-		if err := tx.SelectContext(ctx, &tagIDList, "SELECT id FROM tags WHERE name = ?", keyTagName); err != nil {
-			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get tags: "+err.Error())
-		}
+	livestreamModel, err := getOwnedLivestreamForUpdate(ctx, tx, int64(livestreamID), userID)
+	if err != nil {
+		return err
+	}
+	// 開始済みの配信は予約済みの配信として扱わない
+	if livestreamModel.StartAt <= time.Now().Unix() {
+		return echo.NewHTTPError(http.StatusBadRequest, "can't cancel livestream that has already started")
+	}
 
-		query, params, err := sqlx.In("SELECT * FROM livestream_tags WHERE tag_id IN (?) ORDER BY livestream_id DESC", tagIDList)
-		if err != nil {
-			return echo.NewHTTPError(http.StatusInternalServerError, "failed to construct IN query: "+err.Error())
-		}
-		var keyTaggedLivestreams []*LivestreamTagModel
-		if err := tx.SelectContext(ctx, &keyTaggedLivestreams, query, params...); err != nil {
-			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get keyTaggedLivestreams: "+err.Error())
-		}
+	sr := newSlotReservation()
+	defer sr.Rollback()
+	if err := releaseReservationSlots(ctx, tx, sr, livestreamModel.StartAt, livestreamModel.EndAt); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM livestream_tags WHERE livestream_id = ?", livestreamModel.ID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete livestream tags: "+err.Error())
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM livestreams WHERE id = ?", livestreamModel.ID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete livestream: "+err.Error())
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM livestream_series_members WHERE livestream_id = ?", livestreamModel.ID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete livestream series member: "+err.Error())
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM livestream_collaborators WHERE livestream_id = ?", livestreamModel.ID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete livestream collaborators: "+err.Error())
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM bookmarks WHERE livestream_id = ?", livestreamModel.ID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete bookmarks: "+err.Error())
+	}
 
-		for _, keyTaggedLivestream := range keyTaggedLivestreams {
-			ls := LivestreamModel{}
-			if err := tx.GetContext(ctx, &ls, "SELECT * FROM livestreams WHERE id = ?", keyTaggedLivestream.LivestreamID); err != nil {
-				return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
-			}
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+	sr.Commit()
 
-			livestreamModels = append(livestreamModels, &ls)
-		}
-	} else {
-		// 検索条件なし
-		query := `SELECT * FROM livestreams ORDER BY id DESC`
-		if c.QueryParam("limit") != "" {
-			limit, err := strconv.Atoi(c.QueryParam("limit"))
-			if err != nil {
-				return echo.NewHTTPError(http.StatusBadRequest, "limit query parameter must be integer")
-			}
-			query += fmt.Sprintf(" LIMIT %d", limit)
+	// 空いた枠をキャンセル待ちに回す
+	if err := processReservationWaitlist(ctx, livestreamModel.StartAt, livestreamModel.EndAt); err != nil {
+		c.Logger().Warnf("failed to process reservation waitlist: %v", err)
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// getOwnedLivestreamForUpdate は配信者本人のライブ配信を行ロック付きで取得する
+func getOwnedLivestreamForUpdate(ctx context.Context, tx *sqlx.Tx, livestreamID, userID int64) (LivestreamModel, error) {
+	var livestreamModel LivestreamModel
+	if err := tx.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ? FOR UPDATE", livestreamID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return LivestreamModel{}, echo.NewHTTPError(http.StatusNotFound, "livestream not found")
 		}
+		return LivestreamModel{}, echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+	}
+	if livestreamModel.UserID != userID {
+		return LivestreamModel{}, echo.NewHTTPError(http.StatusForbidden, "can't modify other streamer's livestream")
+	}
+	return livestreamModel, nil
+}
+
+type LiveLivestream struct {
+	Livestream  Livestream `json:"livestream"`
+	ViewerCount int64      `json:"viewer_count"`
+}
+
+// 配信中のライブ配信一覧 (同時視聴者数の多い順)
+// GET /api/livestream/live?limit=
+func getLiveLivestreamsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
 
-		if err := tx.SelectContext(ctx, &livestreamModels, query); err != nil {
-			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
+	limit := 0
+	if c.QueryParam("limit") != "" {
+		l, err := strconv.Atoi(c.QueryParam("limit"))
+		if err != nil || l < 1 {
+			return echo.NewHTTPError(http.StatusBadRequest, "limit query parameter must be positive integer")
 		}
+		limit = l
 	}
 
-	// ポインタスライスを値スライスに変換
-	lsModels := make([]LivestreamModel, len(livestreamModels))
-	for i, lsPtr := range livestreamModels {
-		lsModels[i] = *lsPtr
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
 	}
-	livestreams, err := fillLivestreamsResponse(ctx, tx, lsModels)
+	defer tx.Rollback()
+
+	cond, args, err := livestreamStatusCondition(livestreamStatusLive, time.Now().Unix())
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestreams: "+err.Error())
+		return err
+	}
+	var livestreamModels []LivestreamModel
+	if err := tx.SelectContext(ctx, &livestreamModels, "SELECT * FROM livestreams WHERE "+cond, args...); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
+	}
+
+	lives := []LiveLivestream{}
+	if len(livestreamModels) > 0 {
+		livestreamIDs := make([]int64, len(livestreamModels))
+		for i, l := range livestreamModels {
+			livestreamIDs[i] = l.ID
+		}
+		// 同時視聴者数はハートビートによる在室状況から数える
+		viewerCountMap := presence.concurrent(livestreamIDs, time.Now())
+
+		sort.Slice(livestreamModels, func(i, j int) bool {
+			ci, cj := viewerCountMap[livestreamModels[i].ID], viewerCountMap[livestreamModels[j].ID]
+			if ci != cj {
+				return ci > cj
+			}
+			return livestreamModels[i].ID > livestreamModels[j].ID
+		})
+		if limit > 0 && len(livestreamModels) > limit {
+			livestreamModels = livestreamModels[:limit]
+		}
+
+		livestreams, err := fillLivestreamsResponse(ctx, tx, livestreamModels)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestreams: "+err.Error())
+		}
+		for _, l := range livestreams {
+			lives = append(lives, LiveLivestream{
+				Livestream:  l,
+				ViewerCount: viewerCountMap[l.ID],
+			})
+		}
 	}
 
 	if err := tx.Commit(); err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
 	}
 
-	return c.JSON(http.StatusOK, livestreams)
+	return c.JSON(http.StatusOK, lives)
 }
 
 func getMyLivestreamsHandler(c echo.Context) error {
@@ -300,8 +674,16 @@ func getUserLivestreamsHandler(c echo.Context) error {
 		}
 	}
 
+	// 共同配信者として承諾した配信も含める
 	var livestreamModels []*LivestreamModel
-	if err := tx.SelectContext(ctx, &livestreamModels, "SELECT * FROM livestreams WHERE user_id = ?", user.ID); err != nil {
+	query := `
+		SELECT * FROM livestreams WHERE user_id = ?
+		UNION
+		SELECT l.* FROM livestreams l
+		INNER JOIN livestream_collaborators lc ON lc.livestream_id = l.id
+		WHERE lc.user_id = ? AND lc.status = ?
+	`
+	if err := tx.SelectContext(ctx, &livestreamModels, query, user.ID, user.ID, collaboratorStatusAccepted); err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
 	}
 
@@ -346,10 +728,19 @@ func enterLivestreamHandler(c echo.Context) error {
 	}
 	defer tx.Rollback()
 
+	var livestreamModel LivestreamModel
+	if err := tx.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ?", livestreamID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "livestream not found")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+	}
+
+	now := time.Now()
 	viewer := LivestreamViewerModel{
 		UserID:       int64(userID),
 		LivestreamID: int64(livestreamID),
-		CreatedAt:    time.Now().Unix(),
+		CreatedAt:    now.Unix(),
 	}
 
 	if _, err := tx.NamedExecContext(ctx, "INSERT INTO livestream_viewers_history (user_id, livestream_id, created_at) VALUES(:user_id, :livestream_id, :created_at)", viewer); err != nil {
@@ -360,6 +751,11 @@ func enterLivestreamHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
 	}
 
+	// 在室状況は配信中のライブ配信のみ管理する
+	if err := joinLivestreamPresence(ctx, dbConn, livestreamModel, viewer.UserID, now); err != nil {
+		c.Logger().Warnf("failed to update peak viewers: %v", err)
+	}
+
 	return c.NoContent(http.StatusOK)
 }
 
@@ -386,14 +782,17 @@ func exitLivestreamHandler(c echo.Context) error {
 	}
 	defer tx.Rollback()
 
-	if _, err := tx.ExecContext(ctx, "DELETE FROM livestream_viewers_history WHERE user_id = ? AND livestream_id = ?", userID, livestreamID); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete livestream_view_history: "+err.Error())
+	// 視聴履歴として残すため、削除せず退室時刻を記録する
+	if _, err := tx.ExecContext(ctx, "UPDATE livestream_viewers_history SET exited_at = ? WHERE user_id = ? AND livestream_id = ? AND exited_at = 0", time.Now().Unix(), userID, livestreamID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to update livestream_view_history: "+err.Error())
 	}
 
 	if err := tx.Commit(); err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
 	}
 
+	presence.leave(int64(livestreamID), userID)
+
 	return c.NoContent(http.StatusOK)
 }
 
@@ -511,8 +910,21 @@ func fillLivestreamsResponse(ctx context.Context, tx *sqlx.Tx, livestreamModels
 		livestreamIDs[i] = ls.ID
 	}
 
+	// 承諾済みの共同配信者を一括取得し、owner と一緒に fill する
+	query, args, err := sqlx.In("SELECT * FROM livestream_collaborators WHERE livestream_id IN (?) AND status = ? ORDER BY id", livestreamIDs, collaboratorStatusAccepted)
+	if err != nil {
+		return nil, err
+	}
+	var collaboratorModels []LivestreamCollaboratorModel
+	if err := tx.SelectContext(ctx, &collaboratorModels, query, args...); err != nil {
+		return nil, err
+	}
+	for _, lc := range collaboratorModels {
+		userIDs = append(userIDs, lc.UserID)
+	}
+
 	// users を一括取得
-	query, args, err := sqlx.In("SELECT * FROM users WHERE id IN (?)", userIDs)
+	query, args, err = sqlx.In("SELECT * FROM users WHERE id IN (?)", userIDs)
 	if err != nil {
 		return nil, err
 	}
@@ -578,23 +990,44 @@ func fillLivestreamsResponse(ctx context.Context, tx *sqlx.Tx, livestreamModels
 		}
 	}
 
+	// livestream_id ごとの共同配信者をマップ化
+	livestreamCollaboratorsMap := make(map[int64][]User)
+	for _, lc := range collaboratorModels {
+		livestreamCollaboratorsMap[lc.LivestreamID] = append(livestreamCollaboratorsMap[lc.LivestreamID], userMap[lc.UserID])
+	}
+
+	// 閲覧中のユーザのブックマークを一括取得
+	bookmarkedSet, err := bookmarkedLivestreamIDs(ctx, tx, livestreamIDs)
+	if err != nil {
+		return nil, err
+	}
+
 	// Livestream を構築
+	now := time.Now().Unix()
 	livestreams := make([]Livestream, len(livestreamModels))
 	for i, lsModel := range livestreamModels {
 		tags := livestreamTagsMap[lsModel.ID]
 		if tags == nil {
 			tags = []Tag{}
 		}
+		collaborators := livestreamCollaboratorsMap[lsModel.ID]
+		if collaborators == nil {
+			collaborators = []User{}
+		}
+		_, bookmarked := bookmarkedSet[lsModel.ID]
 		livestreams[i] = Livestream{
-			ID:           lsModel.ID,
-			Owner:        userMap[lsModel.UserID],
-			Title:        lsModel.Title,
-			Tags:         tags,
-			Description:  lsModel.Description,
-			PlaylistUrl:  lsModel.PlaylistUrl,
-			ThumbnailUrl: lsModel.ThumbnailUrl,
-			StartAt:      lsModel.StartAt,
-			EndAt:        lsModel.EndAt,
+			ID:            lsModel.ID,
+			Owner:         userMap[lsModel.UserID],
+			Title:         lsModel.Title,
+			Tags:          tags,
+			Description:   lsModel.Description,
+			PlaylistUrl:   lsModel.PlaylistUrl,
+			ThumbnailUrl:  lsModel.ThumbnailUrl,
+			StartAt:       lsModel.StartAt,
+			EndAt:         lsModel.EndAt,
+			Collaborators: collaborators,
+			Status:        livestreamStatus(lsModel, now),
+			IsBookmarked:  bookmarked,
 		}
 	}
 
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	livestreamSortNewest     = "newest"
+	livestreamSortStartTime  = "start_time"
+	livestreamSortPopularity = "popularity"
+
+	tagModeAnd = "and"
+	tagModeOr  = "or"
+
+	// 次のページのカーソルを返すヘッダ
+	nextCursorHeader = "X-Next-Cursor"
+)
+
+// livestreamSearchRow は並び順のキー (popularity の場合は延べ視聴者数) 付きのライブ配信
+type livestreamSearchRow struct {
+	LivestreamModel
+	Score int64 `db:"score"`
+}
+
+// livestreamSearchCursor は並び順のキーと id の組で、次のページの先頭位置を表す
+type livestreamSearchCursor struct {
+	Key int64
+	ID  int64
+}
+
+func (c livestreamSearchCursor) encode() string {
+	return base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("%d:%d", c.Key, c.ID)))
+}
+
+func decodeLivestreamSearchCursor(s string) (livestreamSearchCursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return livestreamSearchCursor{}, err
+	}
+	key, id, ok := strings.Cut(string(b), ":")
+	if !ok {
+		return livestreamSearchCursor{}, errors.New("malformed cursor")
+	}
+	var cursor livestreamSearchCursor
+	if cursor.Key, err = strconv.ParseInt(key, 10, 64); err != nil {
+		return livestreamSearchCursor{}, err
+	}
+	if cursor.ID, err = strconv.ParseInt(id, 10, 64); err != nil {
+		return livestreamSearchCursor{}, err
+	}
+	return cursor, nil
+}
+
+// escapeLike は LIKE のパターン中の特殊文字をエスケープする
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+// ライブ配信検索API
+// GET /api/livestream/search?q=&tag=&tag=&tag_mode=and|or&streamer=&from=&to=&status=&sort=newest|start_time|popularity&limit=&cursor=
+//
+// q は空白区切りのキーワードで、全てのキーワードがタイトルか説明文に含まれる配信に絞り込む
+// from, to を指定すると、その期間と配信期間が重なる配信に絞り込む
+// limit を指定した場合、続きがあれば次のページのカーソルを X-Next-Cursor ヘッダで返す
+func searchLivestreamsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	var (
+		conds []string
+		args  []interface{}
+	)
+
+	// 配信の状態による絞り込み
+	now := time.Now().Unix()
+	if status := c.QueryParam("status"); status != "" {
+		cond, condArgs, err := livestreamStatusCondition(status, now)
+		if err != nil {
+			return err
+		}
+		conds = append(conds, cond)
+		args = append(args, condArgs...)
+	}
+
+	for _, keyword := range strings.Fields(c.QueryParam("q")) {
+		pattern := "%" + escapeLike(keyword) + "%"
+		conds = append(conds, "(l.title LIKE ? OR l.description LIKE ?)")
+		args = append(args, pattern, pattern)
+	}
+
+	if from := c.QueryParam("from"); from != "" {
+		v, err := strconv.ParseInt(from, 10, 64)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "from query parameter must be integer")
+		}
+		conds = append(conds, "l.end_at > ?")
+		args = append(args, v)
+	}
+	if to := c.QueryParam("to"); to != "" {
+		v, err := strconv.ParseInt(to, 10, 64)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "to query parameter must be integer")
+		}
+		conds = append(conds, "l.start_at < ?")
+		args = append(args, v)
+	}
+
+	sortKey := c.QueryParam("sort")
+	if sortKey == "" {
+		sortKey = livestreamSortNewest
+	}
+	if sortKey != livestreamSortNewest && sortKey != livestreamSortStartTime && sortKey != livestreamSortPopularity {
+		return echo.NewHTTPError(http.StatusBadRequest, "sort query parameter must be one of newest, start_time, popularity")
+	}
+
+	limit := 0
+	if c.QueryParam("limit") != "" {
+		l, err := strconv.Atoi(c.QueryParam("limit"))
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "limit query parameter must be integer")
+		}
+		limit = l
+	}
+
+	var cursor *livestreamSearchCursor
+	if c.QueryParam("cursor") != "" {
+		cur, err := decodeLivestreamSearchCursor(c.QueryParam("cursor"))
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "cursor query parameter is malformed")
+		}
+		cursor = &cur
+	}
+
+	tagMode := c.QueryParam("tag_mode")
+	if tagMode == "" {
+		tagMode = tagModeOr
+	}
+	if tagMode != tagModeAnd && tagMode != tagModeOr {
+		return echo.NewHTTPError(http.StatusBadRequest, "tag_mode query parameter must be one of and, or")
+	}
+	var tagNames []string
+	for _, v := range c.QueryParams()["tag"] {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				tagNames = append(tagNames, name)
+			}
+		}
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	livestreams := []Livestream{}
+	empty := false
+
+	if streamer := c.QueryParam("streamer"); streamer != "" {
+		var streamerID int64
+		if err := tx.GetContext(ctx, &streamerID, "SELECT id FROM users WHERE name = ?", streamer); err != nil {
+			if !errors.Is(err, sql.ErrNoRows) {
+				return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user: "+err.Error())
+			}
+			empty = true
+		}
+		conds = append(conds, "l.user_id = ?")
+		args = append(args, streamerID)
+	}
+
+	if len(tagNames) > 0 {
+		// 別名は正規のタグに解決する
+		resolved, err := resolveTagNames(ctx, tx, tagNames)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get tags: "+err.Error())
+		}
+		tagIDSet := make(map[int64]struct{}, len(resolved))
+		unresolved := false
+		for _, name := range tagNames {
+			id, ok := resolved[name]
+			if !ok {
+				unresolved = true
+				continue
+			}
+			tagIDSet[id] = struct{}{}
+		}
+		tagIDs := make([]int64, 0, len(tagIDSet))
+		for id := range tagIDSet {
+			tagIDs = append(tagIDs, id)
+		}
+
+		switch {
+		case len(tagIDs) == 0:
+			empty = true
+		case tagMode == tagModeAnd:
+			// 指定された全てのタグが付いている配信 (存在しないタグがあれば該当なし)
+			if unresolved {
+				empty = true
+				break
+			}
+			cond, condArgs, err := sqlx.In("l.id IN (SELECT livestream_id FROM livestream_tags WHERE tag_id IN (?) GROUP BY livestream_id HAVING COUNT(DISTINCT tag_id) = ?)", tagIDs, len(tagIDs))
+			if err != nil {
+				return echo.NewHTTPError(http.StatusInternalServerError, "failed to construct IN query: "+err.Error())
+			}
+			conds = append(conds, cond)
+			args = append(args, condArgs...)
+		default:
+			cond, condArgs, err := sqlx.In("l.id IN (SELECT livestream_id FROM livestream_tags WHERE tag_id IN (?))", tagIDs)
+			if err != nil {
+				return echo.NewHTTPError(http.StatusInternalServerError, "failed to construct IN query: "+err.Error())
+			}
+			conds = append(conds, cond)
+			args = append(args, condArgs...)
+		}
+	}
+
+	if !empty {
+		// 並び順ごとのキーとカーソル条件
+		var keyExpr, orderBy, cursorCond string
+		switch sortKey {
+		case livestreamSortNewest:
+			keyExpr, orderBy = "l.id", "l.id DESC"
+			cursorCond = "l.id < ?"
+		case livestreamSortStartTime:
+			keyExpr, orderBy = "l.start_at", "l.start_at ASC, l.id ASC"
+			cursorCond = "(l.start_at > ? OR (l.start_at = ? AND l.id > ?))"
+		case livestreamSortPopularity:
+			keyExpr, orderBy = "IFNULL(p.score, 0)", "score DESC, l.id DESC"
+			cursorCond = "(IFNULL(p.score, 0) < ? OR (IFNULL(p.score, 0) = ? AND l.id < ?))"
+		}
+		if cursor != nil {
+			conds = append(conds, cursorCond)
+			if sortKey == livestreamSortNewest {
+				args = append(args, cursor.ID)
+			} else {
+				args = append(args, cursor.Key, cursor.Key, cursor.ID)
+			}
+		}
+
+		query := "SELECT l.*, " + keyExpr + " AS score FROM livestreams l"
+		if sortKey == livestreamSortPopularity {
+			query += " LEFT JOIN (SELECT livestream_id, COUNT(*) AS score FROM livestream_viewers_history GROUP BY livestream_id) p ON p.livestream_id = l.id"
+		}
+		if len(conds) > 0 {
+			query += " WHERE " + strings.Join(conds, " AND ")
+		}
+		query += " ORDER BY " + orderBy
+		if limit > 0 {
+			// 続きがあるかを判定するため1件多く取得する
+			query += fmt.Sprintf(" LIMIT %d", limit+1)
+		}
+
+		var rows []livestreamSearchRow
+		if err := tx.SelectContext(ctx, &rows, query, args...); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
+		}
+		if limit > 0 && len(rows) > limit {
+			rows = rows[:limit]
+			last := rows[len(rows)-1]
+			c.Response().Header().Set(nextCursorHeader, livestreamSearchCursor{Key: last.Score, ID: last.ID}.encode())
+		}
+
+		lsModels := make([]LivestreamModel, len(rows))
+		for i, row := range rows {
+			lsModels[i] = row.LivestreamModel
+		}
+		livestreams, err = fillLivestreamsResponse(ctx, tx, lsModels)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestreams: "+err.Error())
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, livestreams)
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+type LivestreamTagsRequest struct {
+	Tags []int64 `json:"tags"`
+}
+
+// uniqueTagIDs は重複を除いたタグIDを元の順序で返す
+func uniqueTagIDs(tagIDs []int64) []int64 {
+	seen := make(map[int64]struct{}, len(tagIDs))
+	unique := make([]int64, 0, len(tagIDs))
+	for _, id := range tagIDs {
+		if _, ok := seen[id]; ok {
+			continue
+		}
+		seen[id] = struct{}{}
+		unique = append(unique, id)
+	}
+	return unique
+}
+
+// ライブ配信へのタグの追加 (既に付いているタグは無視する)
+// POST /api/livestream/:livestream_id/tag
+func addLivestreamTagsHandler(c echo.Context) error {
+	return editLivestreamTags(c, func(ctx context.Context, tx *sqlx.Tx, livestreamID int64, tagIDs []int64) error {
+		var current []int64
+		if err := tx.SelectContext(ctx, &current, "SELECT tag_id FROM livestream_tags WHERE livestream_id = ?", livestreamID); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream tags: "+err.Error())
+		}
+		exists := make(map[int64]struct{}, len(current))
+		for _, id := range current {
+			exists[id] = struct{}{}
+		}
+		var adding []int64
+		for _, id := range tagIDs {
+			if _, ok := exists[id]; !ok {
+				adding = append(adding, id)
+			}
+		}
+		if err := insertLivestreamTags(ctx, tx, livestreamID, adding); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert livestream tag: "+err.Error())
+		}
+		return nil
+	})
+}
+
+// ライブ配信のタグの置き換え
+// PUT /api/livestream/:livestream_id/tag
+func replaceLivestreamTagsHandler(c echo.Context) error {
+	return editLivestreamTags(c, replaceLivestreamTags)
+}
+
+// replaceLivestreamTags はライブ配信のタグを置き換える
+// tagIDs は uniqueTagIDs で重複を除き、validateTagIDs で検証しておく
+func replaceLivestreamTags(ctx context.Context, tx *sqlx.Tx, livestreamID int64, tagIDs []int64) error {
+	if _, err := tx.ExecContext(ctx, "DELETE FROM livestream_tags WHERE livestream_id = ?", livestreamID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete livestream tags: "+err.Error())
+	}
+	if err := insertLivestreamTags(ctx, tx, livestreamID, tagIDs); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert livestream tag: "+err.Error())
+	}
+	return nil
+}
+
+// ライブ配信からのタグの削除
+// DELETE /api/livestream/:livestream_id/tag/:tag_id
+func removeLivestreamTagHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+	tagID, err := strconv.Atoi(c.Param("tag_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "tag_id in path must be integer")
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	livestreamModel, err := getOwnedLivestreamForUpdate(ctx, tx, int64(livestreamID), userID)
+	if err != nil {
+		return err
+	}
+
+	rs, err := tx.ExecContext(ctx, "DELETE FROM livestream_tags WHERE livestream_id = ? AND tag_id = ?", livestreamModel.ID, tagID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete livestream tag: "+err.Error())
+	}
+	if n, err := rs.RowsAffected(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get affected rows: "+err.Error())
+	} else if n == 0 {
+		return echo.NewHTTPError(http.StatusNotFound, "the tag is not attached to the livestream")
+	}
+
+	livestream, err := fillLivestreamResponse(ctx, tx, livestreamModel)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestream: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, livestream)
+}
+
+// editLivestreamTags は配信者本人のライブ配信について、検証済みのタグIDで edit を実行し、更新後のライブ配信を返す
+func editLivestreamTags(c echo.Context, edit func(ctx context.Context, tx *sqlx.Tx, livestreamID int64, tagIDs []int64) error) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	var req LivestreamTagsRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+	tagIDs := uniqueTagIDs(req.Tags)
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	livestreamModel, err := getOwnedLivestreamForUpdate(ctx, tx, int64(livestreamID), userID)
+	if err != nil {
+		return err
+	}
+	if err := validateTagIDs(ctx, tx, tagIDs); err != nil {
+		return err
+	}
+	if err := edit(ctx, tx, livestreamModel.ID, tagIDs); err != nil {
+		return err
+	}
+
+	livestream, err := fillLivestreamResponse(ctx, tx, livestreamModel)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestream: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, livestream)
+}
@@ -4,6 +4,7 @@ package main
 // sqlx的な参考: https://jmoiron.github.io/sqlx/
 
 import (
+	"context"
 	"fmt"
 	"github.com/go-sql-driver/mysql"
 	"github.com/gorilla/sessions"
@@ -18,11 +19,17 @@ import (
 	"os"
 	"os/exec"
 	"strconv"
+	"time"
 )
 
 const (
 	listenPort                     = 8080
 	powerDNSSubdomainAddressEnvKey = "ISUCON13_POWERDNS_SUBDOMAIN_ADDRESS"
+
+	paymentProviderEnvKey      = "ISUCON13_PAYMENT_PROVIDER"
+	mockPaymentAddressEnvKey   = "ISUCON13_MOCK_PAYMENT_ADDRESS"
+	paymentWebhookURLEnvKey    = "ISUCON13_PAYMENT_WEBHOOK_URL"
+	paymentWebhookSecretEnvKey = "ISUCON13_PAYMENT_WEBHOOK_SECRETKEY"
 )
 
 var (
@@ -36,6 +43,16 @@ func init() {
 	if secretKey, ok := os.LookupEnv("ISUCON13_SESSION_SECRETKEY"); ok {
 		secret = []byte(secretKey)
 	}
+	if secretKey, ok := os.LookupEnv(paymentWebhookSecretEnvKey); ok {
+		paymentWebhookSecret = []byte(secretKey)
+	}
+	if v, ok := os.LookupEnv("ISUCON13_PLATFORM_FEE_PERCENT"); ok {
+		percent, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || percent < 0 || percent > 100 {
+			log.Fatalf("ISUCON13_PLATFORM_FEE_PERCENT must be an integer between 0 and 100: %s", v)
+		}
+		platformFeePercent = percent
+	}
 }
 
 type InitializeResponse struct {
@@ -118,6 +135,36 @@ func initializeHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to initialize: "+err.Error())
 	}
 
+	// 予約枠のアロケータを初期データで作り直す
+	if err := loadSlotAllocator(c.Request().Context(), dbConn); err != nil {
+		c.Logger().Warnf("failed to load reservation slots: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to initialize: "+err.Error())
+	}
+
+	// ユーザ検索のインデックスを初期データで作り直す
+	if err := loadUserIndex(c.Request().Context(), dbConn); err != nil {
+		c.Logger().Warnf("failed to load user index: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to initialize: "+err.Error())
+	}
+
+	// 盛り上がりの集計を初期データで作り直す
+	if err := loadTrending(c.Request().Context(), dbConn); err != nil {
+		c.Logger().Warnf("failed to load trending: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to initialize: "+err.Error())
+	}
+
+	// 在室状況を初期データで作り直す
+	if err := loadPresence(c.Request().Context(), dbConn); err != nil {
+		c.Logger().Warnf("failed to load presence: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to initialize: "+err.Error())
+	}
+
+	// ローリング期間が設定されていれば初期データの後ろに予約枠を作成
+	if _, err := extendReservationSlots(c.Request().Context(), dbConn, reservationConf, time.Now()); err != nil {
+		c.Logger().Warnf("failed to extend reservation slots: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to initialize: "+err.Error())
+	}
+
 	c.Request().Header.Add("Content-Type", "application/json;charset=utf-8")
 	return c.JSON(http.StatusOK, InitializeResponse{
 		Language: "golang",
@@ -132,6 +179,7 @@ func main() {
 	cookieStore := sessions.NewCookieStore(secret)
 	cookieStore.Options.Domain = "*.t.isucon.pw"
 	e.Use(session.Middleware(cookieStore))
+	e.Use(viewerMiddleware)
 	// e.Use(middleware.Recover())
 
 	// 初期化
@@ -144,16 +192,47 @@ func main() {
 	// livestream
 	// reserve livestream
 	e.POST("/api/livestream/reservation", reserveLivestreamHandler)
+	// 満席の区間のキャンセル待ち
+	e.POST("/api/livestream/reservation/waitlist", joinReservationWaitlistHandler)
+	e.GET("/api/livestream/reservation/waitlist", getReservationWaitlistHandler)
+	e.DELETE("/api/livestream/reservation/waitlist/:waitlist_id", leaveReservationWaitlistHandler)
+	// 繰り返し予約
+	e.POST("/api/livestream/reservation/series", reserveLivestreamSeriesHandler)
+	e.GET("/api/livestream/series/:series_id", getLivestreamSeriesHandler)
+	e.PATCH("/api/livestream/series/:series_id", updateLivestreamSeriesHandler)
+	e.DELETE("/api/livestream/series/:series_id", cancelLivestreamSeriesHandler)
+	// reservation availability
+	e.GET("/api/reservation/availability", getReservationAvailabilityHandler)
 	// list livestream
 	e.GET("/api/livestream/search", searchLivestreamsHandler)
+	e.GET("/api/livestream/live", getLiveLivestreamsHandler)
+	// おすすめのライブ配信
+	e.GET("/api/livestream/recommended", getRecommendedLivestreamsHandler)
+	// 盛り上がっているライブ配信
+	e.GET("/api/livestream/trending", getTrendingLivestreamsHandler)
 	e.GET("/api/livestream", getMyLivestreamsHandler)
 	e.GET("/api/user/:username/livestream", getUserLivestreamsHandler)
 	// get livestream
 	e.GET("/api/livestream/:livestream_id", getLivestreamHandler)
+	// edit / cancel reserved livestream
+	e.PATCH("/api/livestream/:livestream_id", updateLivestreamHandler)
+	e.DELETE("/api/livestream/:livestream_id", cancelLivestreamHandler)
+	// 配信者によるタグの追加・置き換え・削除
+	e.POST("/api/livestream/:livestream_id/tag", addLivestreamTagsHandler)
+	e.PUT("/api/livestream/:livestream_id/tag", replaceLivestreamTagsHandler)
+	e.DELETE("/api/livestream/:livestream_id/tag/:tag_id", removeLivestreamTagHandler)
+	// ブックマーク
+	e.POST("/api/livestream/:livestream_id/bookmark", bookmarkLivestreamHandler)
+	e.DELETE("/api/livestream/:livestream_id/bookmark", unbookmarkLivestreamHandler)
+	// 共同配信の招待への返答
+	e.POST("/api/livestream/:livestream_id/collaboration/accept", acceptCollaborationHandler)
+	e.POST("/api/livestream/:livestream_id/collaboration/decline", declineCollaborationHandler)
 	// get polling livecomment timeline
 	e.GET("/api/livestream/:livestream_id/livecomment", getLivecommentsHandler)
 	// ライブコメント投稿
 	e.POST("/api/livestream/:livestream_id/livecomment", postLivecommentHandler)
+	// 配信者によるライブコメント削除 (チップの返金有無を指定できる)
+	e.DELETE("/api/livestream/:livestream_id/livecomment/:livecomment_id", deleteLivecommentHandler)
 	e.POST("/api/livestream/:livestream_id/reaction", postReactionHandler)
 	e.GET("/api/livestream/:livestream_id/reaction", getReactionsHandler)
 
@@ -170,26 +249,71 @@ func main() {
 	e.POST("/api/livestream/:livestream_id/enter", enterLivestreamHandler)
 	// ユーザ視聴終了 (viewer)
 	e.DELETE("/api/livestream/:livestream_id/exit", exitLivestreamHandler)
+	// 視聴中であることの通知 (viewer)
+	e.POST("/api/livestream/:livestream_id/heartbeat", heartbeatLivestreamHandler)
+	// 配信中の視聴者一覧 (streamer)
+	e.GET("/api/livestream/:livestream_id/viewer", getLiveViewersHandler)
 
 	// user
 	e.POST("/api/register", registerHandler)
 	e.POST("/api/login", loginHandler)
 	e.GET("/api/user/me", getMeHandler)
+	e.GET("/api/user/search", searchUsersHandler)
+	e.GET("/api/user/me/collaboration", getCollaborationInvitationsHandler)
+	e.GET("/api/user/me/bookmark", getBookmarksHandler)
+	e.GET("/api/user/me/history", getViewerHistoryHandler)
 	// フロントエンドで、配信予約のコラボレーターを指定する際に必要
 	e.GET("/api/user/:username", getUserHandler)
 	e.GET("/api/user/:username/statistics", getUserStatisticsHandler)
 	e.GET("/api/user/:username/icon", getIconHandler)
+	// フォロー・フォロー解除
+	e.POST("/api/user/:username/follow", followUserHandler)
+	e.DELETE("/api/user/:username/follow", unfollowUserHandler)
+	// フォローしている配信者の予約中・配信中のライブ配信
+	e.GET("/api/feed", getFeedHandler)
 	e.POST("/api/icon", postIconHandler)
+	// 通知
+	e.GET("/api/notification", getNotificationsHandler)
 
 	// stats
 	// ライブ配信統計情報
 	e.GET("/api/livestream/:livestream_id/statistics", getLivestreamStatisticsHandler)
+	// チップ上位のサポーター
+	e.GET("/api/livestream/:livestream_id/supporters", getLivestreamSupportersHandler)
+	e.GET("/api/user/:username/supporters", getUserSupportersHandler)
+
+	// admin
+	e.POST("/api/admin/reservation_slots/generate", generateReservationSlotsHandler)
+	e.POST("/api/admin/reservation_slots/capacity", updateReservationSlotsCapacityHandler)
+	e.GET("/api/admin/tag", getAdminTagsHandler)
+	e.POST("/api/admin/tag", postTagHandler)
+	e.PATCH("/api/admin/tag/:tag_id", renameTagHandler)
+	e.DELETE("/api/admin/tag/:tag_id", deleteTagHandler)
+	e.POST("/api/admin/tag/:tag_id/merge", mergeTagHandler)
+	e.POST("/api/admin/tag/:tag_id/alias", postTagAliasHandler)
+	e.DELETE("/api/admin/tag/:tag_id/alias/:alias_id", deleteTagAliasHandler)
 
 	// 課金情報
 	e.GET("/api/payment", GetPaymentResult)
+	// 決済代行サービス経由のチップ付きライブコメント投稿
+	e.POST("/api/livestream/:livestream_id/livecomment/charge", postLivecommentChargeHandler)
+	e.GET("/api/payment/charge/:reference", getPaymentChargeHandler)
+	// 決済代行サービスからの webhook
+	e.POST("/api/payment/webhook", paymentWebhookHandler)
+	// 配信者向け月次精算書 (json, csv, pdf)
+	e.GET("/api/user/:username/statement", getPayoutStatementHandler)
 
 	e.HTTPErrorHandler = errorResponseHandler
 
+	// 予約の設定を読み込む
+	conf, err := loadReservationConfig()
+	if err != nil {
+		e.Logger.Errorf("failed to load reservation config: %v", err)
+		os.Exit(1)
+	}
+	reservationConf = conf
+	loadAdminUsernames()
+
 	// DB接続
 	conn, err := connectDB(e.Logger)
 	if err != nil {
@@ -212,6 +336,61 @@ func main() {
 		os.Exit(1)
 	}
 
+	// 予約枠のアロケータを初期化
+	if err := loadSlotAllocator(context.Background(), dbConn); err != nil {
+		e.Logger.Errorf("failed to load reservation slots: %v", err)
+		os.Exit(1)
+	}
+
+	// ユーザ検索のインデックスを初期化
+	if err := loadUserIndex(context.Background(), dbConn); err != nil {
+		e.Logger.Errorf("failed to load user index: %v", err)
+		os.Exit(1)
+	}
+
+	// 盛り上がりの集計を初期化
+	if err := loadTrending(context.Background(), dbConn); err != nil {
+		e.Logger.Errorf("failed to load trending: %v", err)
+		os.Exit(1)
+	}
+
+	// 在室状況を初期化
+	if err := loadPresence(context.Background(), dbConn); err != nil {
+		e.Logger.Errorf("failed to load presence: %v", err)
+		os.Exit(1)
+	}
+
+	// ハートビートが途絶えた視聴者を定期的に在室状況から取り除く
+	go func() {
+		ticker := time.NewTicker(presenceSweepInterval)
+		defer ticker.Stop()
+		for now := range ticker.C {
+			presence.sweep(now)
+		}
+	}()
+
+	// ローリング期間が設定されていれば、予約枠を定期的に作成し続ける
+	if reservationConf.RollingHorizon > 0 {
+		go func() {
+			ticker := time.NewTicker(time.Hour)
+			defer ticker.Stop()
+			for {
+				if n, err := extendReservationSlots(context.Background(), dbConn, reservationConf, time.Now()); err != nil {
+					e.Logger.Warnf("failed to extend reservation slots: %v", err)
+				} else if n > 0 {
+					e.Logger.Infof("generated %d reservation slots", n)
+				}
+				<-ticker.C
+			}
+		}()
+	}
+
+	// 決済代行サービスを初期化
+	// 決済代行サービスを用意できなくても、課金以外の機能は提供できるので起動は続ける
+	if err := initPaymentProvider(e.Logger); err != nil {
+		e.Logger.Errorf("failed to initialize payment provider, charges are disabled: %v", err)
+	}
+
 	// HTTPサーバ起動
 	listenAddr := net.JoinHostPort("", strconv.Itoa(listenPort))
 	if err := e.Start(listenAddr); err != nil {
@@ -220,6 +399,42 @@ func main() {
 	}
 }
 
+// initPaymentProvider は決済代行サービスを選択する
+// 現状はモックのみで、ISUCON13_PAYMENT_PROVIDER=mock の場合にローカルにモック決済サーバを起動してそこに課金を依頼する
+// 設定がない場合や初期化に失敗した場合は課金を受け付けない
+func initPaymentProvider(logger echo.Logger) error {
+	paymentProvider = disabledPaymentProvider{}
+
+	switch provider := os.Getenv(paymentProviderEnvKey); provider {
+	case "":
+		logger.Warnf("%s is not set, charges are disabled", paymentProviderEnvKey)
+		return nil
+	case "mock":
+		mockAddr := net.JoinHostPort("127.0.0.1", "18080")
+		if v, ok := os.LookupEnv(mockPaymentAddressEnvKey); ok {
+			mockAddr = v
+		}
+		webhookURL := fmt.Sprintf("http://%s/api/payment/webhook", net.JoinHostPort("127.0.0.1", strconv.Itoa(listenPort)))
+		if v, ok := os.LookupEnv(paymentWebhookURLEnvKey); ok {
+			webhookURL = v
+		}
+
+		listener, err := net.Listen("tcp", mockAddr)
+		if err != nil {
+			return err
+		}
+		go func() {
+			if err := http.Serve(listener, newMockPaymentServer(webhookURL, paymentWebhookSecret)); err != nil {
+				logger.Errorf("mock payment server stopped: %v", err)
+			}
+		}()
+		paymentProvider = newMockPaymentProvider("http://"+listener.Addr().String(), paymentWebhookSecret)
+		return nil
+	default:
+		return fmt.Errorf("unknown payment provider: %s", provider)
+	}
+}
+
 type ErrorResponse struct {
 	Error string `json:"error"`
 }
@@ -227,6 +442,13 @@ type ErrorResponse struct {
 func errorResponseHandler(err error, c echo.Context) {
 	c.Logger().Errorf("error at %s: %+v", c.Path(), err)
 	if he, ok := err.(*echo.HTTPError); ok {
+		// 文字列以外のメッセージは構造化されたエラーレスポンスとしてそのまま返す
+		if _, isString := he.Message.(string); !isString && he.Message != nil {
+			if e := c.JSON(he.Code, he.Message); e != nil {
+				c.Logger().Errorf("%+v", e)
+			}
+			return
+		}
 		if e := c.JSON(he.Code, &ErrorResponse{Error: err.Error()}); e != nil {
 			c.Logger().Errorf("%+v", e)
 		}
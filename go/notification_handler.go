@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	notificationKindWaitlistFulfilled = "waitlist_fulfilled"
+
+	defaultNotificationsLimit = 50
+)
+
+type NotificationModel struct {
+	ID           int64  `db:"id"`
+	UserID       int64  `db:"user_id"`
+	Kind         string `db:"kind"`
+	Message      string `db:"message"`
+	LivestreamID int64  `db:"livestream_id"`
+	CreatedAt    int64  `db:"created_at"`
+}
+
+type Notification struct {
+	ID           int64  `json:"id"`
+	Kind         string `json:"kind"`
+	Message      string `json:"message"`
+	LivestreamID int64  `json:"livestream_id,omitempty"`
+	CreatedAt    int64  `json:"created_at"`
+}
+
+// insertNotification はユーザへの通知を作成する
+func insertNotification(ctx context.Context, tx *sqlx.Tx, userID int64, kind, message string, livestreamID int64) error {
+	_, err := tx.NamedExecContext(ctx, "INSERT INTO notifications (user_id, kind, message, livestream_id, created_at) VALUES (:user_id, :kind, :message, :livestream_id, :created_at)", &NotificationModel{
+		UserID:       userID,
+		Kind:         kind,
+		Message:      message,
+		LivestreamID: livestreamID,
+		CreatedAt:    time.Now().Unix(),
+	})
+	return err
+}
+
+// 通知一覧取得API
+// GET /api/notification?limit=50
+func getNotificationsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	limit := defaultNotificationsLimit
+	if c.QueryParam("limit") != "" {
+		l, err := strconv.Atoi(c.QueryParam("limit"))
+		if err != nil || l < 1 {
+			return echo.NewHTTPError(http.StatusBadRequest, "limit query parameter must be positive integer")
+		}
+		limit = l
+	}
+
+	var notificationModels []NotificationModel
+	query := fmt.Sprintf("SELECT * FROM notifications WHERE user_id = ? ORDER BY created_at DESC, id DESC LIMIT %d", limit)
+	if err := dbConn.SelectContext(ctx, &notificationModels, query, userID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get notifications: "+err.Error())
+	}
+
+	notifications := make([]Notification, len(notificationModels))
+	for i, n := range notificationModels {
+		notifications[i] = Notification{
+			ID:           n.ID,
+			Kind:         n.Kind,
+			Message:      n.Message,
+			LivestreamID: n.LivestreamID,
+			CreatedAt:    n.CreatedAt,
+		}
+	}
+
+	return c.JSON(http.StatusOK, notifications)
+}
@@ -1,15 +1,41 @@
 package main
 
 import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io"
 	"net/http"
+	"strconv"
+	"time"
 
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo-contrib/session"
 	"github.com/labstack/echo/v4"
 )
 
+const (
+	tipLedgerKindTip    = "tip"
+	tipLedgerKindRefund = "refund"
+)
+
 type PaymentResult struct {
 	TotalTip int64 `json:"total_tip"`
 }
 
+// TipLedgerModel はチップの台帳。返金は負の金額の反対仕訳として記録する
+type TipLedgerModel struct {
+	ID            int64  `db:"id"`
+	LivecommentID int64  `db:"livecomment_id"`
+	UserID        int64  `db:"user_id"`
+	LivestreamID  int64  `db:"livestream_id"`
+	Kind          string `db:"kind"`
+	Amount        int64  `db:"amount"`
+	CreatedAt     int64  `db:"created_at"`
+}
+
 func GetPaymentResult(c echo.Context) error {
 	ctx := c.Request().Context()
 
@@ -20,7 +46,7 @@ func GetPaymentResult(c echo.Context) error {
 	defer tx.Rollback()
 
 	var totalTip int64
-	if err := tx.GetContext(ctx, &totalTip, "SELECT IFNULL(SUM(tip), 0) FROM livecomments"); err != nil {
+	if err := tx.GetContext(ctx, &totalTip, "SELECT IFNULL(SUM(amount), 0) FROM tip_ledger"); err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to count total tip: "+err.Error())
 	}
 
@@ -32,3 +58,349 @@ func GetPaymentResult(c echo.Context) error {
 		TotalTip: totalTip,
 	})
 }
+
+// recordTip はチップ付きライブコメントの投稿を台帳に記録する
+func recordTip(ctx context.Context, tx *sqlx.Tx, livecomment LivecommentModel) error {
+	if livecomment.Tip <= 0 {
+		return nil
+	}
+	_, err := tx.NamedExecContext(ctx, "INSERT INTO tip_ledger (livecomment_id, user_id, livestream_id, kind, amount, created_at) VALUES (:livecomment_id, :user_id, :livestream_id, :kind, :amount, :created_at)", &TipLedgerModel{
+		LivecommentID: livecomment.ID,
+		UserID:        livecomment.UserID,
+		LivestreamID:  livecomment.LivestreamID,
+		Kind:          tipLedgerKindTip,
+		Amount:        livecomment.Tip,
+		CreatedAt:     livecomment.CreatedAt,
+	})
+	return err
+}
+
+// refundTips はライブコメントのチップを返金し、反対仕訳を台帳に記録する
+// 削除時に返金しない場合は台帳に手を付けず、チップは配信者の売上として残る
+func refundTips(ctx context.Context, tx *sqlx.Tx, livecomments []*LivecommentModel) error {
+	var tippedIDs []int64
+	for _, livecomment := range livecomments {
+		if livecomment.Tip > 0 {
+			tippedIDs = append(tippedIDs, livecomment.ID)
+		}
+	}
+	if len(tippedIDs) == 0 {
+		return nil
+	}
+
+	// 削除時の返金とチャージバックが重複しないよう、返金済みなら何もしない
+	query, args, err := sqlx.In("SELECT livecomment_id FROM tip_ledger WHERE livecomment_id IN (?) AND kind = ?", tippedIDs, tipLedgerKindRefund)
+	if err != nil {
+		return err
+	}
+	var refundedIDs []int64
+	if err := tx.SelectContext(ctx, &refundedIDs, query, args...); err != nil {
+		return err
+	}
+	refunded := make(map[int64]struct{}, len(refundedIDs))
+	for _, id := range refundedIDs {
+		refunded[id] = struct{}{}
+	}
+
+	now := time.Now().Unix()
+	for _, livecomment := range livecomments {
+		if livecomment.Tip <= 0 {
+			continue
+		}
+		if _, ok := refunded[livecomment.ID]; ok {
+			continue
+		}
+		if _, err := tx.NamedExecContext(ctx, "INSERT INTO tip_ledger (livecomment_id, user_id, livestream_id, kind, amount, created_at) VALUES (:livecomment_id, :user_id, :livestream_id, :kind, :amount, :created_at)", &TipLedgerModel{
+			LivecommentID: livecomment.ID,
+			UserID:        livecomment.UserID,
+			LivestreamID:  livecomment.LivestreamID,
+			Kind:          tipLedgerKindRefund,
+			Amount:        -livecomment.Tip,
+			CreatedAt:     now,
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+const (
+	paymentChargeStatusPending   = "pending"
+	paymentChargeStatusSucceeded = "succeeded"
+	paymentChargeStatusFailed    = "failed"
+	paymentChargeStatusRefunded  = "refunded"
+)
+
+type PaymentChargeModel struct {
+	ID               int64  `db:"id"`
+	Reference        string `db:"reference"`
+	ProviderChargeID string `db:"provider_charge_id"`
+	UserID           int64  `db:"user_id"`
+	LivestreamID     int64  `db:"livestream_id"`
+	Comment          string `db:"comment"`
+	Amount           int64  `db:"amount"`
+	Status           string `db:"status"`
+	LivecommentID    int64  `db:"livecomment_id"`
+	CreatedAt        int64  `db:"created_at"`
+	UpdatedAt        int64  `db:"updated_at"`
+}
+
+type PaymentCharge struct {
+	Reference     string `json:"reference"`
+	LivestreamID  int64  `json:"livestream_id"`
+	Comment       string `json:"comment"`
+	Amount        int64  `json:"amount"`
+	Status        string `json:"status"`
+	LivecommentID int64  `json:"livecomment_id,omitempty"`
+	CreatedAt     int64  `json:"created_at"`
+	UpdatedAt     int64  `json:"updated_at"`
+}
+
+func toPaymentCharge(m PaymentChargeModel) PaymentCharge {
+	return PaymentCharge{
+		Reference:     m.Reference,
+		LivestreamID:  m.LivestreamID,
+		Comment:       m.Comment,
+		Amount:        m.Amount,
+		Status:        m.Status,
+		LivecommentID: m.LivecommentID,
+		CreatedAt:     m.CreatedAt,
+		UpdatedAt:     m.UpdatedAt,
+	}
+}
+
+// 決済代行サービス経由のチップ付きライブコメント投稿
+// 決済が成功した時点 (webhook 受信時) でライブコメントが作成される
+// POST /api/livestream/:livestream_id/livecomment/charge
+func postLivecommentChargeHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	if _, ok := paymentProvider.(disabledPaymentProvider); ok {
+		return echo.NewHTTPError(http.StatusServiceUnavailable, errPaymentProviderDisabled.Error())
+	}
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	var req *PostLivecommentRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+	if req.Tip <= 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "tip must be positive")
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	var livestreamModel LivestreamModel
+	if err := tx.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ?", livestreamID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "livestream not found")
+		} else {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+		}
+	}
+
+	hit, err := hitNGWords(ctx, tx, livestreamModel, req.Comment)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get NG words: "+err.Error())
+	}
+	if hit {
+		return echo.NewHTTPError(http.StatusBadRequest, "このコメントがスパム判定されました")
+	}
+
+	now := time.Now().Unix()
+	chargeModel := PaymentChargeModel{
+		Reference:    uuid.NewString(),
+		UserID:       userID,
+		LivestreamID: livestreamModel.ID,
+		Comment:      req.Comment,
+		Amount:       req.Tip,
+		Status:       paymentChargeStatusPending,
+		CreatedAt:    now,
+		UpdatedAt:    now,
+	}
+	rs, err := tx.NamedExecContext(ctx, "INSERT INTO payment_charges (reference, user_id, livestream_id, comment, amount, status, created_at, updated_at) VALUES (:reference, :user_id, :livestream_id, :comment, :amount, :status, :created_at, :updated_at)", &chargeModel)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert payment charge: "+err.Error())
+	}
+	chargeID, err := rs.LastInsertId()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get last inserted payment charge id: "+err.Error())
+	}
+	chargeModel.ID = chargeID
+
+	// webhook が届いた時に参照できるよう、決済代行サービスを呼ぶ前にコミットしておく
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	providerCharge, err := paymentProvider.CreateCharge(ctx, ChargeRequest{
+		Reference: chargeModel.Reference,
+		Amount:    chargeModel.Amount,
+	})
+	if err != nil {
+		chargeModel.Status = paymentChargeStatusFailed
+		if _, err := dbConn.ExecContext(ctx, "UPDATE payment_charges SET status = ?, updated_at = ? WHERE id = ? AND status = ?", paymentChargeStatusFailed, time.Now().Unix(), chargeModel.ID, paymentChargeStatusPending); err != nil {
+			c.Logger().Warnf("failed to mark payment charge as failed: %v", err)
+		}
+		return echo.NewHTTPError(http.StatusBadGateway, "failed to create charge: "+err.Error())
+	}
+
+	if _, err := dbConn.ExecContext(ctx, "UPDATE payment_charges SET provider_charge_id = ? WHERE id = ?", providerCharge.ID, chargeModel.ID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to update payment charge: "+err.Error())
+	}
+
+	return c.JSON(http.StatusAccepted, toPaymentCharge(chargeModel))
+}
+
+// 課金状態の取得
+// GET /api/payment/charge/:reference
+func getPaymentChargeHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	var chargeModel PaymentChargeModel
+	if err := dbConn.GetContext(ctx, &chargeModel, "SELECT * FROM payment_charges WHERE reference = ?", c.Param("reference")); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "payment charge not found")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get payment charge: "+err.Error())
+	}
+	if chargeModel.UserID != userID {
+		return echo.NewHTTPError(http.StatusNotFound, "payment charge not found")
+	}
+
+	return c.JSON(http.StatusOK, toPaymentCharge(chargeModel))
+}
+
+// 決済代行サービスからの webhook 受信
+// 署名を検証した上で、課金の結果をライブコメントとチップの台帳に反映する
+// POST /api/payment/webhook
+func paymentWebhookHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	payload, err := io.ReadAll(c.Request().Body)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to read the request body")
+	}
+
+	if err := paymentProvider.VerifyWebhook(payload, c.Request().Header.Get(paymentSignatureHeader), time.Now()); err != nil {
+		return echo.NewHTTPError(http.StatusUnauthorized, "invalid webhook signature: "+err.Error())
+	}
+
+	var event PaymentWebhookEvent
+	if err := json.Unmarshal(payload, &event); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	var chargeModel PaymentChargeModel
+	if err := tx.GetContext(ctx, &chargeModel, "SELECT * FROM payment_charges WHERE reference = ? FOR UPDATE", event.Reference); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "payment charge not found")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get payment charge: "+err.Error())
+	}
+	if chargeModel.Amount != event.Amount {
+		return echo.NewHTTPError(http.StatusBadRequest, "amount does not match the charge")
+	}
+
+	// 同じイベントが再送されても結果が変わらないよう、状態遷移できる場合のみ反映する
+	now := time.Now().Unix()
+	var postedLivecomment *LivecommentModel
+	switch event.Type {
+	case paymentEventChargeSucceeded:
+		if chargeModel.Status != paymentChargeStatusPending {
+			break
+		}
+		livecommentModel := LivecommentModel{
+			UserID:       chargeModel.UserID,
+			LivestreamID: chargeModel.LivestreamID,
+			Comment:      chargeModel.Comment,
+			Tip:          chargeModel.Amount,
+			CreatedAt:    now,
+		}
+		rs, err := tx.NamedExecContext(ctx, "INSERT INTO livecomments (user_id, livestream_id, comment, tip, created_at) VALUES (:user_id, :livestream_id, :comment, :tip, :created_at)", livecommentModel)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert livecomment: "+err.Error())
+		}
+		livecommentID, err := rs.LastInsertId()
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get last inserted livecomment id: "+err.Error())
+		}
+		livecommentModel.ID = livecommentID
+
+		if err := recordTip(ctx, tx, livecommentModel); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to record tip: "+err.Error())
+		}
+		if _, err := tx.ExecContext(ctx, "UPDATE payment_charges SET status = ?, livecomment_id = ?, updated_at = ? WHERE id = ?", paymentChargeStatusSucceeded, livecommentID, now, chargeModel.ID); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to update payment charge: "+err.Error())
+		}
+		postedLivecomment = &livecommentModel
+	case paymentEventChargeFailed:
+		if chargeModel.Status != paymentChargeStatusPending {
+			break
+		}
+		if _, err := tx.ExecContext(ctx, "UPDATE payment_charges SET status = ?, updated_at = ? WHERE id = ?", paymentChargeStatusFailed, now, chargeModel.ID); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to update payment charge: "+err.Error())
+		}
+	case paymentEventChargeRefunded:
+		if chargeModel.Status != paymentChargeStatusSucceeded {
+			break
+		}
+		if err := refundTips(ctx, tx, []*LivecommentModel{{
+			ID:           chargeModel.LivecommentID,
+			UserID:       chargeModel.UserID,
+			LivestreamID: chargeModel.LivestreamID,
+			Tip:          chargeModel.Amount,
+		}}); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to refund tip: "+err.Error())
+		}
+		if _, err := tx.ExecContext(ctx, "UPDATE payment_charges SET status = ?, updated_at = ? WHERE id = ?", paymentChargeStatusRefunded, now, chargeModel.ID); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to update payment charge: "+err.Error())
+		}
+	default:
+		return echo.NewHTTPError(http.StatusBadRequest, "unknown webhook event type: "+event.Type)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	if postedLivecomment != nil {
+		trending.recordLivecomment(postedLivecomment.LivestreamID, postedLivecomment.Tip, time.Unix(now, 0))
+	}
+
+	return c.NoContent(http.StatusOK)
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	paymentSignatureHeader = "X-Isupipe-Signature"
+	// 署名のタイムスタンプの許容誤差 (リプレイ対策)
+	paymentSignatureTolerance = 5 * time.Minute
+
+	paymentEventChargeSucceeded = "charge.succeeded"
+	paymentEventChargeFailed    = "charge.failed"
+	paymentEventChargeRefunded  = "charge.refunded"
+)
+
+var (
+	paymentProvider      PaymentProvider = disabledPaymentProvider{}
+	paymentWebhookSecret                 = []byte("isucon13_payment_webhook_defaultsecret")
+)
+
+// PaymentProvider は決済代行サービスとのやり取りを抽象化する
+// 決済結果は CreateCharge の戻り値ではなく、非同期の署名付き webhook で通知される
+type PaymentProvider interface {
+	CreateCharge(ctx context.Context, req ChargeRequest) (*ProviderCharge, error)
+	VerifyWebhook(payload []byte, signature string, now time.Time) error
+}
+
+type ChargeRequest struct {
+	// Reference はアプリケーション側の課金ID。webhook でそのまま返ってくる
+	Reference string `json:"reference"`
+	Amount    int64  `json:"amount"`
+}
+
+type ProviderCharge struct {
+	ID        string `json:"id"`
+	Reference string `json:"reference"`
+	Amount    int64  `json:"amount"`
+	Status    string `json:"status"`
+}
+
+type PaymentWebhookEvent struct {
+	ID        string `json:"id"`
+	Type      string `json:"type"`
+	ChargeID  string `json:"charge_id"`
+	Reference string `json:"reference"`
+	Amount    int64  `json:"amount"`
+	CreatedAt int64  `json:"created_at"`
+}
+
+// signPaymentPayload は "t=<unix>,v1=<hex(hmac-sha256(secret, "<unix>.<payload>"))>" 形式の署名を作る
+func signPaymentPayload(secret, payload []byte, now time.Time) string {
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(payload)
+	return fmt.Sprintf("t=%s,v1=%s", timestamp, hex.EncodeToString(mac.Sum(nil)))
+}
+
+func verifyPaymentSignature(secret, payload []byte, signature string, now time.Time) error {
+	var timestamp, v1 string
+	for _, part := range strings.Split(signature, ",") {
+		k, v, ok := strings.Cut(part, "=")
+		if !ok {
+			continue
+		}
+		switch k {
+		case "t":
+			timestamp = v
+		case "v1":
+			v1 = v
+		}
+	}
+	if timestamp == "" || v1 == "" {
+		return errors.New("malformed signature")
+	}
+
+	t, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return errors.New("malformed signature timestamp")
+	}
+	if d := now.Sub(time.Unix(t, 0)); d > paymentSignatureTolerance || d < -paymentSignatureTolerance {
+		return errors.New("signature timestamp is out of tolerance")
+	}
+
+	expected := signPaymentPayload(secret, payload, time.Unix(t, 0))
+	if !hmac.Equal([]byte(expected), []byte(fmt.Sprintf("t=%s,v1=%s", timestamp, v1))) {
+		return errors.New("signature mismatch")
+	}
+	return nil
+}
+
+// errPaymentProviderDisabled は決済代行サービスが設定されていないことを表す
+var errPaymentProviderDisabled = errors.New("payment provider is not configured")
+
+// disabledPaymentProvider は決済代行サービスが設定されていない場合に使う
+// 課金は受け付けず、webhook もすべて拒否する
+type disabledPaymentProvider struct{}
+
+func (disabledPaymentProvider) CreateCharge(ctx context.Context, req ChargeRequest) (*ProviderCharge, error) {
+	return nil, errPaymentProviderDisabled
+}
+
+func (disabledPaymentProvider) VerifyWebhook(payload []byte, signature string, now time.Time) error {
+	return errPaymentProviderDisabled
+}
+
+// mockPaymentProvider はローカルで動くモック決済サーバに HTTP で課金を依頼する
+type mockPaymentProvider struct {
+	baseURL string
+	secret  []byte
+	client  *http.Client
+}
+
+func newMockPaymentProvider(baseURL string, secret []byte) *mockPaymentProvider {
+	return &mockPaymentProvider{
+		baseURL: baseURL,
+		secret:  secret,
+		client:  &http.Client{Timeout: 5 * time.Second},
+	}
+}
+
+func (p *mockPaymentProvider) CreateCharge(ctx context.Context, req ChargeRequest) (*ProviderCharge, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, p.baseURL+"/v1/charges", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+
+	resp, err := p.client.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusAccepted {
+		b, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("payment provider returned %d: %s", resp.StatusCode, string(b))
+	}
+
+	var charge ProviderCharge
+	if err := json.NewDecoder(resp.Body).Decode(&charge); err != nil {
+		return nil, err
+	}
+	return &charge, nil
+}
+
+func (p *mockPaymentProvider) VerifyWebhook(payload []byte, signature string, now time.Time) error {
+	return verifyPaymentSignature(p.secret, payload, signature, now)
+}
+
+// mockPaymentServer は決済代行サービスの代わりに動くローカルの HTTP サーバ
+//
+//	POST /v1/charges              課金を受け付け、非同期に charge.succeeded か charge.failed を通知する
+//	POST /v1/charges/:id/refund   返金 (チャージバック) を受け付け、非同期に charge.refunded を通知する
+//
+// 金額が mockPaymentChargeLimit を超える課金は失敗扱いになる
+type mockPaymentServer struct {
+	webhookURL string
+	secret     []byte
+	delay      time.Duration
+	client     *http.Client
+
+	mu      sync.Mutex
+	charges map[string]*ProviderCharge
+}
+
+const mockPaymentChargeLimit = 1000000
+
+func newMockPaymentServer(webhookURL string, secret []byte) *mockPaymentServer {
+	return &mockPaymentServer{
+		webhookURL: webhookURL,
+		secret:     secret,
+		delay:      100 * time.Millisecond,
+		client:     &http.Client{Timeout: 5 * time.Second},
+		charges:    make(map[string]*ProviderCharge),
+	}
+}
+
+func (s *mockPaymentServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if r.URL.Path == "/v1/charges" {
+		s.handleCreateCharge(w, r)
+		return
+	}
+	if id, ok := strings.CutPrefix(r.URL.Path, "/v1/charges/"); ok {
+		if id, ok := strings.CutSuffix(id, "/refund"); ok {
+			s.handleRefundCharge(w, id)
+			return
+		}
+	}
+	http.NotFound(w, r)
+}
+
+func (s *mockPaymentServer) handleCreateCharge(w http.ResponseWriter, r *http.Request) {
+	var req ChargeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "failed to decode the request body as json", http.StatusBadRequest)
+		return
+	}
+	if req.Reference == "" || req.Amount <= 0 {
+		http.Error(w, "reference and positive amount are required", http.StatusBadRequest)
+		return
+	}
+
+	charge := &ProviderCharge{
+		ID:        "ch_" + uuid.NewString(),
+		Reference: req.Reference,
+		Amount:    req.Amount,
+		Status:    "pending",
+	}
+
+	eventType := paymentEventChargeSucceeded
+	status := "succeeded"
+	if req.Amount > mockPaymentChargeLimit {
+		eventType = paymentEventChargeFailed
+		status = "failed"
+	}
+
+	s.mu.Lock()
+	s.charges[charge.ID] = &ProviderCharge{ID: charge.ID, Reference: charge.Reference, Amount: charge.Amount, Status: status}
+	s.mu.Unlock()
+
+	go s.sendWebhook(eventType, *charge)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(charge)
+}
+
+func (s *mockPaymentServer) handleRefundCharge(w http.ResponseWriter, id string) {
+	s.mu.Lock()
+	charge, ok := s.charges[id]
+	if ok && charge.Status == "succeeded" {
+		charge.Status = "refunded"
+	} else {
+		ok = false
+	}
+	s.mu.Unlock()
+	if !ok {
+		http.Error(w, "no refundable charge", http.StatusNotFound)
+		return
+	}
+
+	go s.sendWebhook(paymentEventChargeRefunded, *charge)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(charge)
+}
+
+func (s *mockPaymentServer) sendWebhook(eventType string, charge ProviderCharge) {
+	time.Sleep(s.delay)
+
+	now := time.Now()
+	payload, err := json.Marshal(PaymentWebhookEvent{
+		ID:        "evt_" + uuid.NewString(),
+		Type:      eventType,
+		ChargeID:  charge.ID,
+		Reference: charge.Reference,
+		Amount:    charge.Amount,
+		CreatedAt: now.Unix(),
+	})
+	if err != nil {
+		log.Printf("mock payment: failed to marshal webhook: %v", err)
+		return
+	}
+
+	req, err := http.NewRequest(http.MethodPost, s.webhookURL, bytes.NewReader(payload))
+	if err != nil {
+		log.Printf("mock payment: failed to build webhook request: %v", err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(paymentSignatureHeader, signPaymentPayload(s.secret, payload, now))
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		log.Printf("mock payment: webhook call failed: %v", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		log.Printf("mock payment: webhook returned %d for %s", resp.StatusCode, eventType)
+	}
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+// 最後のハートビートからこの時間が経った視聴者は退室したものとみなす
+// クライアントはこれより短い間隔でハートビートを送る
+const presenceTimeout = 30 * time.Second
+
+// ハートビートが途絶えた視聴者と終了したライブ配信を在室状況から取り除く間隔
+const presenceSweepInterval = 10 * time.Second
+
+// 視聴中のユーザの在室状況
+//
+// 配信中のライブ配信への入室で作り、ハートビートと退室で更新して同時視聴者数を数える
+// ハートビートが途絶えた視聴者と終了したライブ配信は sweep でメモリ上からのみ取り除く
+// 視聴履歴の exited_at は退室 API でのみ記録するので、viewers_count の数え方は変わらない
+// 最大同時視聴者数は livestreams.peak_viewers に記録する
+var presence = newPresenceTracker(presenceTimeout)
+
+type presenceViewer struct {
+	userID   int64
+	joinedAt time.Time
+	lastSeen time.Time
+}
+
+type livestreamPresence struct {
+	endAt   time.Time
+	viewers map[int64]*presenceViewer
+}
+
+type presenceTracker struct {
+	mu          sync.Mutex
+	timeout     time.Duration
+	livestreams map[int64]*livestreamPresence
+}
+
+func newPresenceTracker(timeout time.Duration) *presenceTracker {
+	return &presenceTracker{
+		timeout:     timeout,
+		livestreams: make(map[int64]*livestreamPresence),
+	}
+}
+
+// active は視聴者がまだ在室しているかを返す
+func (p *presenceTracker) active(lp *livestreamPresence, v *presenceViewer, now time.Time) bool {
+	return now.Before(lp.endAt) && now.Sub(v.lastSeen) <= p.timeout
+}
+
+// activeViewers は在室中の視聴者を返す。呼び出し側で mu を保持していること
+func (p *presenceTracker) activeViewers(livestreamID int64, now time.Time) []*presenceViewer {
+	lp, ok := p.livestreams[livestreamID]
+	if !ok {
+		return nil
+	}
+	var viewers []*presenceViewer
+	for _, v := range lp.viewers {
+		if p.active(lp, v, now) {
+			viewers = append(viewers, v)
+		}
+	}
+	return viewers
+}
+
+// join は配信中のライブ配信に視聴者を在室させ、同時視聴者数を返す
+// 既に在室している場合は入室時刻を変えずにハートビートとして扱う
+func (p *presenceTracker) join(livestream LivestreamModel, userID int64, now time.Time) int64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	lp, ok := p.livestreams[livestream.ID]
+	if !ok {
+		lp = &livestreamPresence{endAt: time.Unix(livestream.EndAt, 0), viewers: make(map[int64]*presenceViewer)}
+		p.livestreams[livestream.ID] = lp
+	}
+	if v, ok := lp.viewers[userID]; ok && p.active(lp, v, now) {
+		v.lastSeen = now
+	} else {
+		lp.viewers[userID] = &presenceViewer{userID: userID, joinedAt: now, lastSeen: now}
+	}
+	return int64(len(p.activeViewers(livestream.ID, now)))
+}
+
+// heartbeat は在室中の視聴者の最終確認時刻を更新する。在室していなければ false を返す
+func (p *presenceTracker) heartbeat(livestreamID, userID int64, now time.Time) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	lp, ok := p.livestreams[livestreamID]
+	if !ok {
+		return false
+	}
+	v, ok := lp.viewers[userID]
+	if !ok || !p.active(lp, v, now) {
+		return false
+	}
+	v.lastSeen = now
+	return true
+}
+
+func (p *presenceTracker) leave(livestreamID, userID int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if lp, ok := p.livestreams[livestreamID]; ok {
+		delete(lp.viewers, userID)
+	}
+}
+
+// concurrent は配信ごとの同時視聴者数を返す
+func (p *presenceTracker) concurrent(livestreamIDs []int64, now time.Time) map[int64]int64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	counts := make(map[int64]int64, len(livestreamIDs))
+	for _, id := range livestreamIDs {
+		counts[id] = int64(len(p.activeViewers(id, now)))
+	}
+	return counts
+}
+
+// present は在室中の視聴者を返す
+func (p *presenceTracker) present(livestreamID int64, now time.Time) []presenceViewer {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	active := p.activeViewers(livestreamID, now)
+	viewers := make([]presenceViewer, len(active))
+	for i, v := range active {
+		viewers[i] = *v
+	}
+	return viewers
+}
+
+// sweep はハートビートが途絶えた視聴者と終了したライブ配信を取り除く
+func (p *presenceTracker) sweep(now time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for livestreamID, lp := range p.livestreams {
+		for userID, v := range lp.viewers {
+			if !p.active(lp, v, now) {
+				delete(lp.viewers, userID)
+			}
+		}
+		if !now.Before(lp.endAt) {
+			delete(p.livestreams, livestreamID)
+		}
+	}
+}
+
+func (p *presenceTracker) reset() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.livestreams = make(map[int64]*livestreamPresence)
+}
+
+// joinLivestreamPresence は配信中のライブ配信であれば視聴者を在室させ、最大同時視聴者数を更新する
+func joinLivestreamPresence(ctx context.Context, db sqlx.ExecerContext, livestream LivestreamModel, userID int64, now time.Time) error {
+	if livestreamStatus(livestream, now.Unix()) != livestreamStatusLive {
+		return nil
+	}
+	concurrent := presence.join(livestream, userID, now)
+	_, err := db.ExecContext(ctx, "UPDATE livestreams SET peak_viewers = GREATEST(peak_viewers, ?) WHERE id = ?", concurrent, livestream.ID)
+	return err
+}
+
+// loadPresence は在室状況を作り直す
+// 配信中のライブ配信に退室せずに入室から presenceTimeout 以内の視聴者は在室として扱う
+func loadPresence(ctx context.Context, db *sqlx.DB) error {
+	presence.reset()
+
+	now := time.Now()
+	var viewers []struct {
+		LivestreamModel
+		ViewerID int64 `db:"viewer_id"`
+		JoinedAt int64 `db:"joined_at"`
+	}
+	query := `SELECT l.*, h.user_id AS viewer_id, h.created_at AS joined_at
+		FROM livestream_viewers_history h
+		INNER JOIN livestreams l ON l.id = h.livestream_id
+		WHERE h.exited_at = 0 AND h.created_at >= ? AND l.start_at <= ? AND l.end_at > ?
+		ORDER BY h.created_at`
+	if err := db.SelectContext(ctx, &viewers, query, now.Add(-presenceTimeout).Unix(), now.Unix(), now.Unix()); err != nil {
+		return err
+	}
+	for _, v := range viewers {
+		presence.join(v.LivestreamModel, v.ViewerID, time.Unix(v.JoinedAt, 0))
+	}
+	return nil
+}
+
+// 視聴中であることの通知 (viewer)
+// POST /api/livestream/:livestream_id/heartbeat
+//
+// 入室していないか、ハートビートが途絶えて退室扱いになった場合は 404 を返すので、入室し直す
+func heartbeatLivestreamHandler(c echo.Context) error {
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	if !presence.heartbeat(int64(livestreamID), userID, time.Now()) {
+		return echo.NewHTTPError(http.StatusNotFound, "not present in the livestream")
+	}
+
+	return c.NoContent(http.StatusOK)
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// recordingDriver は実行された SQL を記録するだけのドライバ
+type recordingDriver struct {
+	mu      sync.Mutex
+	queries []string
+}
+
+func (d *recordingDriver) Open(string) (driver.Conn, error) { return &recordingConn{d: d}, nil }
+
+func (d *recordingDriver) recorded() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]string(nil), d.queries...)
+}
+
+type recordingConn struct{ d *recordingDriver }
+
+func (c *recordingConn) Prepare(query string) (driver.Stmt, error) {
+	return &recordingStmt{d: c.d, query: query}, nil
+}
+func (c *recordingConn) Close() error              { return nil }
+func (c *recordingConn) Begin() (driver.Tx, error) { return c, nil }
+func (c *recordingConn) Commit() error             { return nil }
+func (c *recordingConn) Rollback() error           { return nil }
+
+type recordingStmt struct {
+	d     *recordingDriver
+	query string
+}
+
+func (s *recordingStmt) Close() error  { return nil }
+func (s *recordingStmt) NumInput() int { return -1 }
+func (s *recordingStmt) Exec([]driver.Value) (driver.Result, error) {
+	s.d.mu.Lock()
+	defer s.d.mu.Unlock()
+	s.d.queries = append(s.d.queries, s.query)
+	return driver.RowsAffected(1), nil
+}
+func (s *recordingStmt) Query([]driver.Value) (driver.Rows, error) {
+	return nil, driver.ErrSkip
+}
+
+var presenceTestDriver = &recordingDriver{}
+
+func init() {
+	sql.Register("presence_recording", presenceTestDriver)
+}
+
+// viewers_count は視聴履歴のうち exited_at = 0 の行を数えるので、
+// ハートビートが途絶えた視聴者や終了したライブ配信を在室状況から取り除いても視聴履歴を書き換えないことを確かめる
+func TestPresenceSweepKeepsViewersCount(t *testing.T) {
+	db, err := sqlx.Open("presence_recording", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	t.Cleanup(presence.reset)
+	presence.reset()
+
+	now := time.Unix(1_700_000_000, 0)
+	livestream := LivestreamModel{ID: 1, StartAt: now.Add(-time.Hour).Unix(), EndAt: now.Add(time.Hour).Unix()}
+	ended := LivestreamModel{ID: 2, StartAt: now.Add(-time.Hour).Unix(), EndAt: now.Add(presenceTimeout).Unix()}
+
+	ctx := context.Background()
+	for _, l := range []LivestreamModel{livestream, ended} {
+		for _, userID := range []int64{10, 20} {
+			if err := joinLivestreamPresence(ctx, db, l, userID, now); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if !presence.heartbeat(livestream.ID, 10, now.Add(presenceTimeout/2)) {
+		t.Fatal("heartbeat of a present viewer failed")
+	}
+
+	// user 20 はハートビートが途絶え、ライブ配信 2 は終了している
+	later := now.Add(presenceTimeout/2 + presenceTimeout - time.Second)
+	presence.sweep(later)
+
+	counts := presence.concurrent([]int64{livestream.ID, ended.ID}, later)
+	if counts[livestream.ID] != 1 {
+		t.Errorf("concurrent viewers of livestream %d = %d, want 1", livestream.ID, counts[livestream.ID])
+	}
+	if counts[ended.ID] != 0 {
+		t.Errorf("concurrent viewers of ended livestream %d = %d, want 0", ended.ID, counts[ended.ID])
+	}
+	if presence.heartbeat(livestream.ID, 20, later) {
+		t.Error("heartbeat of a swept viewer succeeded")
+	}
+
+	for _, q := range presenceTestDriver.recorded() {
+		if strings.Contains(q, "livestream_viewers_history") {
+			t.Errorf("presence wrote to livestream_viewers_history, which changes viewers_count: %s", q)
+		}
+	}
+}
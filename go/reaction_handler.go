@@ -133,6 +133,8 @@ func postReactionHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
 	}
 
+	trending.recordReaction(reactionModel.LivestreamID, time.Unix(reactionModel.CreatedAt, 0))
+
 	return c.JSON(http.StatusCreated, reaction)
 }
 
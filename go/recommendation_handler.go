@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	defaultRecommendationLimit = 20
+	maxRecommendationLimit     = 100
+)
+
+// 行動ごとの関心の重み (視聴より反応、反応よりコメントを強い関心とみなす)
+const (
+	recommendationWeightView     = 1.0
+	recommendationWeightReaction = 2.0
+	recommendationWeightComment  = 3.0
+)
+
+// スコアの各要素の重み。各要素は 0〜1 に正規化してから重み付けする
+const (
+	recommendationWeightTag        = 0.5
+	recommendationWeightStreamer   = 0.3
+	recommendationWeightPopularity = 0.2
+)
+
+// recommendationEngagement はユーザがライブ配信に対して行った行動の重み付きの合計
+type recommendationEngagement struct {
+	LivestreamID int64   `db:"livestream_id"`
+	StreamerID   int64   `db:"streamer_id"`
+	Weight       float64 `db:"weight"`
+}
+
+// recommendationProfile はユーザのタグ・配信者ごとの関心の強さ
+type recommendationProfile struct {
+	tagAffinity      map[int64]float64
+	streamerAffinity map[int64]float64
+}
+
+// recommendationCandidate はおすすめの候補となるライブ配信
+type recommendationCandidate struct {
+	livestream LivestreamModel
+	tagIDs     []int64
+	popularity int64
+}
+
+// buildRecommendationProfile は行動の履歴から関心の強さを集計する
+// 配信に付いたタグと配信者に、その配信に対する行動の重みを加算する
+func buildRecommendationProfile(engagements []recommendationEngagement, livestreamTags map[int64][]int64) recommendationProfile {
+	profile := recommendationProfile{
+		tagAffinity:      make(map[int64]float64),
+		streamerAffinity: make(map[int64]float64),
+	}
+	for _, e := range engagements {
+		profile.streamerAffinity[e.StreamerID] += e.Weight
+		for _, tagID := range livestreamTags[e.LivestreamID] {
+			profile.tagAffinity[tagID] += e.Weight
+		}
+	}
+	return profile
+}
+
+// rankRecommendations は候補をスコアの高い順に並べる
+// スコアが同じ場合は開始の早い順、id の小さい順に並べるので、同じ入力に対して結果は常に同じになる
+func rankRecommendations(candidates []recommendationCandidate, profile recommendationProfile) []recommendationCandidate {
+	var maxTag, maxStreamer float64
+	for _, v := range profile.tagAffinity {
+		maxTag = math.Max(maxTag, v)
+	}
+	for _, v := range profile.streamerAffinity {
+		maxStreamer = math.Max(maxStreamer, v)
+	}
+	var maxPopularity int64
+	for _, c := range candidates {
+		maxPopularity = max(maxPopularity, c.popularity)
+	}
+
+	scores := make(map[int64]float64, len(candidates))
+	for _, c := range candidates {
+		var score float64
+		if maxTag > 0 && len(c.tagIDs) > 0 {
+			// タグの関心の平均 (タグの多い配信が有利にならないようにする)
+			var sum float64
+			for _, tagID := range c.tagIDs {
+				sum += profile.tagAffinity[tagID]
+			}
+			score += recommendationWeightTag * sum / float64(len(c.tagIDs)) / maxTag
+		}
+		if maxStreamer > 0 {
+			score += recommendationWeightStreamer * profile.streamerAffinity[c.livestream.UserID] / maxStreamer
+		}
+		if maxPopularity > 0 {
+			// 一部の人気配信だけが上位を占めないよう対数で均す
+			score += recommendationWeightPopularity * math.Log1p(float64(c.popularity)) / math.Log1p(float64(maxPopularity))
+		}
+		scores[c.livestream.ID] = score
+	}
+
+	ranked := make([]recommendationCandidate, len(candidates))
+	copy(ranked, candidates)
+	sort.SliceStable(ranked, func(i, j int) bool {
+		si, sj := scores[ranked[i].livestream.ID], scores[ranked[j].livestream.ID]
+		if si != sj {
+			return si > sj
+		}
+		if ranked[i].livestream.StartAt != ranked[j].livestream.StartAt {
+			return ranked[i].livestream.StartAt < ranked[j].livestream.StartAt
+		}
+		return ranked[i].livestream.ID < ranked[j].livestream.ID
+	})
+	return ranked
+}
+
+// getLivestreamTagIDs はライブ配信ごとのタグIDを一括で取得する
+func getLivestreamTagIDs(ctx context.Context, tx *sqlx.Tx, livestreamIDs []int64) (map[int64][]int64, error) {
+	tagIDs := make(map[int64][]int64, len(livestreamIDs))
+	if len(livestreamIDs) == 0 {
+		return tagIDs, nil
+	}
+	query, args, err := sqlx.In("SELECT * FROM livestream_tags WHERE livestream_id IN (?) ORDER BY id", livestreamIDs)
+	if err != nil {
+		return nil, err
+	}
+	var livestreamTagModels []LivestreamTagModel
+	if err := tx.SelectContext(ctx, &livestreamTagModels, query, args...); err != nil {
+		return nil, err
+	}
+	for _, lt := range livestreamTagModels {
+		tagIDs[lt.LivestreamID] = append(tagIDs[lt.LivestreamID], lt.TagID)
+	}
+	return tagIDs, nil
+}
+
+// おすすめのライブ配信 (予約中・配信中のもの)
+// GET /api/livestream/recommended?limit=20
+//
+// 視聴・リアクション・ライブコメントの履歴から求めたタグと配信者への関心と、延べ視聴者数による人気を組み合わせて並べる
+// 履歴がないユーザには人気順で返す
+func getRecommendedLivestreamsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	limit := defaultRecommendationLimit
+	if c.QueryParam("limit") != "" {
+		l, err := strconv.Atoi(c.QueryParam("limit"))
+		if err != nil || l < 1 || l > maxRecommendationLimit {
+			return echo.NewHTTPError(http.StatusBadRequest, "limit query parameter must be between 1 and "+strconv.Itoa(maxRecommendationLimit))
+		}
+		limit = l
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	var engagements []recommendationEngagement
+	query := `SELECT e.livestream_id, l.user_id AS streamer_id, SUM(e.weight) AS weight FROM (
+		SELECT livestream_id, ? AS weight FROM livestream_viewers_history WHERE user_id = ?
+		UNION ALL SELECT livestream_id, ? AS weight FROM reactions WHERE user_id = ?
+		UNION ALL SELECT livestream_id, ? AS weight FROM livecomments WHERE user_id = ?
+	) e INNER JOIN livestreams l ON l.id = e.livestream_id
+	GROUP BY e.livestream_id, l.user_id`
+	if err := tx.SelectContext(ctx, &engagements, query,
+		recommendationWeightView, userID,
+		recommendationWeightReaction, userID,
+		recommendationWeightComment, userID,
+	); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get engagements: "+err.Error())
+	}
+	engagedIDs := make([]int64, len(engagements))
+	for i, e := range engagements {
+		engagedIDs[i] = e.LivestreamID
+	}
+	engagedTags, err := getLivestreamTagIDs(ctx, tx, engagedIDs)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream tags: "+err.Error())
+	}
+	profile := buildRecommendationProfile(engagements, engagedTags)
+
+	// 自分の配信は候補から除く
+	var livestreamModels []LivestreamModel
+	if err := tx.SelectContext(ctx, &livestreamModels, "SELECT * FROM livestreams WHERE end_at > ? AND user_id != ?", time.Now().Unix(), userID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
+	}
+
+	livestreams := []Livestream{}
+	if len(livestreamModels) > 0 {
+		livestreamIDs := make([]int64, len(livestreamModels))
+		for i, l := range livestreamModels {
+			livestreamIDs[i] = l.ID
+		}
+		candidateTags, err := getLivestreamTagIDs(ctx, tx, livestreamIDs)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream tags: "+err.Error())
+		}
+		query, args, err := sqlx.In("SELECT livestream_id, COUNT(*) AS viewer_count FROM livestream_viewers_history WHERE livestream_id IN (?) GROUP BY livestream_id", livestreamIDs)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to construct IN query: "+err.Error())
+		}
+		var counts []struct {
+			LivestreamID int64 `db:"livestream_id"`
+			ViewerCount  int64 `db:"viewer_count"`
+		}
+		if err := tx.SelectContext(ctx, &counts, query, args...); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to count viewers: "+err.Error())
+		}
+		viewerCountMap := make(map[int64]int64, len(counts))
+		for _, vc := range counts {
+			viewerCountMap[vc.LivestreamID] = vc.ViewerCount
+		}
+
+		candidates := make([]recommendationCandidate, len(livestreamModels))
+		for i, l := range livestreamModels {
+			candidates[i] = recommendationCandidate{
+				livestream: l,
+				tagIDs:     candidateTags[l.ID],
+				popularity: viewerCountMap[l.ID],
+			}
+		}
+		ranked := rankRecommendations(candidates, profile)
+		if len(ranked) > limit {
+			ranked = ranked[:limit]
+		}
+		rankedModels := make([]LivestreamModel, len(ranked))
+		for i, r := range ranked {
+			rankedModels[i] = r.livestream
+		}
+
+		livestreams, err = fillLivestreamsResponse(ctx, tx, rankedModels)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestreams: "+err.Error())
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, livestreams)
+}
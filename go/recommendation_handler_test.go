@@ -0,0 +1,192 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestBuildRecommendationProfile(t *testing.T) {
+	tests := []struct {
+		name             string
+		engagements      []recommendationEngagement
+		livestreamTags   map[int64][]int64
+		tagAffinity      map[int64]float64
+		streamerAffinity map[int64]float64
+	}{
+		{
+			name:             "no engagements",
+			tagAffinity:      map[int64]float64{},
+			streamerAffinity: map[int64]float64{},
+		},
+		{
+			name: "weights are added to every tag of the livestream and its streamer",
+			engagements: []recommendationEngagement{
+				{LivestreamID: 1, StreamerID: 10, Weight: recommendationWeightComment},
+				{LivestreamID: 2, StreamerID: 10, Weight: recommendationWeightView},
+				{LivestreamID: 3, StreamerID: 20, Weight: recommendationWeightReaction},
+			},
+			livestreamTags: map[int64][]int64{
+				1: {100, 101},
+				2: {101},
+				3: {102},
+			},
+			tagAffinity:      map[int64]float64{100: 3, 101: 4, 102: 2},
+			streamerAffinity: map[int64]float64{10: 4, 20: 2},
+		},
+		{
+			name: "livestreams without tags only count for the streamer",
+			engagements: []recommendationEngagement{
+				{LivestreamID: 1, StreamerID: 10, Weight: recommendationWeightView},
+			},
+			livestreamTags:   map[int64][]int64{},
+			tagAffinity:      map[int64]float64{},
+			streamerAffinity: map[int64]float64{10: 1},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			profile := buildRecommendationProfile(tt.engagements, tt.livestreamTags)
+			if !reflect.DeepEqual(profile.tagAffinity, tt.tagAffinity) {
+				t.Errorf("tagAffinity = %v, want %v", profile.tagAffinity, tt.tagAffinity)
+			}
+			if !reflect.DeepEqual(profile.streamerAffinity, tt.streamerAffinity) {
+				t.Errorf("streamerAffinity = %v, want %v", profile.streamerAffinity, tt.streamerAffinity)
+			}
+		})
+	}
+}
+
+func TestRankRecommendations(t *testing.T) {
+	candidate := func(id, streamerID, startAt int64, tagIDs []int64, popularity int64) recommendationCandidate {
+		return recommendationCandidate{
+			livestream: LivestreamModel{ID: id, UserID: streamerID, StartAt: startAt},
+			tagIDs:     tagIDs,
+			popularity: popularity,
+		}
+	}
+	emptyProfile := recommendationProfile{
+		tagAffinity:      map[int64]float64{},
+		streamerAffinity: map[int64]float64{},
+	}
+
+	tests := []struct {
+		name       string
+		candidates []recommendationCandidate
+		profile    recommendationProfile
+		want       []int64
+	}{
+		{
+			name:       "no candidates",
+			candidates: nil,
+			profile:    emptyProfile,
+			want:       []int64{},
+		},
+		{
+			name: "empty profile falls back to popularity",
+			candidates: []recommendationCandidate{
+				candidate(1, 10, 100, []int64{100}, 5),
+				candidate(2, 20, 100, nil, 50),
+				candidate(3, 30, 100, []int64{101}, 0),
+			},
+			profile: emptyProfile,
+			want:    []int64{2, 1, 3},
+		},
+		{
+			name: "empty profile without any viewers keeps start_at and id order",
+			candidates: []recommendationCandidate{
+				candidate(3, 10, 200, nil, 0),
+				candidate(2, 20, 100, nil, 0),
+				candidate(1, 30, 200, nil, 0),
+			},
+			profile: emptyProfile,
+			want:    []int64{2, 1, 3},
+		},
+		{
+			name: "tag affinity outweighs popularity",
+			candidates: []recommendationCandidate{
+				candidate(1, 10, 100, []int64{100}, 0),
+				candidate(2, 20, 100, []int64{101}, 1000),
+			},
+			profile: recommendationProfile{
+				tagAffinity:      map[int64]float64{100: 6},
+				streamerAffinity: map[int64]float64{},
+			},
+			want: []int64{1, 2},
+		},
+		{
+			name: "stronger tag affinity ranks higher",
+			candidates: []recommendationCandidate{
+				candidate(1, 10, 100, []int64{101}, 0),
+				candidate(2, 20, 100, []int64{100}, 0),
+				candidate(3, 30, 100, []int64{102}, 0),
+			},
+			profile: recommendationProfile{
+				tagAffinity:      map[int64]float64{100: 6, 101: 3},
+				streamerAffinity: map[int64]float64{},
+			},
+			want: []int64{2, 1, 3},
+		},
+		{
+			name: "tag affinity is averaged so extra unrelated tags do not help",
+			candidates: []recommendationCandidate{
+				candidate(1, 10, 100, []int64{100, 101, 102}, 0),
+				candidate(2, 20, 100, []int64{100}, 0),
+			},
+			profile: recommendationProfile{
+				tagAffinity:      map[int64]float64{100: 3},
+				streamerAffinity: map[int64]float64{},
+			},
+			want: []int64{2, 1},
+		},
+		{
+			name: "streamer affinity ranks followed streamers first",
+			candidates: []recommendationCandidate{
+				candidate(1, 10, 100, nil, 10),
+				candidate(2, 20, 100, nil, 10),
+			},
+			profile: recommendationProfile{
+				tagAffinity:      map[int64]float64{},
+				streamerAffinity: map[int64]float64{20: 1},
+			},
+			want: []int64{2, 1},
+		},
+		{
+			name: "popularity breaks ties between equal affinities",
+			candidates: []recommendationCandidate{
+				candidate(1, 10, 100, []int64{100}, 3),
+				candidate(2, 20, 100, []int64{100}, 30),
+				candidate(3, 30, 100, []int64{100}, 0),
+			},
+			profile: recommendationProfile{
+				tagAffinity:      map[int64]float64{100: 1},
+				streamerAffinity: map[int64]float64{},
+			},
+			want: []int64{2, 1, 3},
+		},
+		{
+			name: "equal scores are ordered by start_at then id",
+			candidates: []recommendationCandidate{
+				candidate(4, 10, 200, []int64{100}, 7),
+				candidate(3, 20, 100, []int64{100}, 7),
+				candidate(2, 30, 200, []int64{100}, 7),
+			},
+			profile: recommendationProfile{
+				tagAffinity:      map[int64]float64{100: 1},
+				streamerAffinity: map[int64]float64{},
+			},
+			want: []int64{3, 2, 4},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ranked := rankRecommendations(tt.candidates, tt.profile)
+			got := make([]int64, len(ranked))
+			for i, r := range ranked {
+				got[i] = r.livestream.ID
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ranked ids = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
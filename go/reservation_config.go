@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	reservationTermStartEnvKey      = "ISUCON13_RESERVATION_TERM_START"
+	reservationTermEndEnvKey        = "ISUCON13_RESERVATION_TERM_END"
+	reservationRollingHorizonEnvKey = "ISUCON13_RESERVATION_ROLLING_HORIZON"
+	reservationSlotDurationEnvKey   = "ISUCON13_RESERVATION_SLOT_DURATION"
+	reservationSlotCapacityEnvKey   = "ISUCON13_RESERVATION_SLOT_CAPACITY"
+
+	reservationMaxFutureReservationsEnvKey = "ISUCON13_RESERVATION_MAX_FUTURE_RESERVATIONS"
+	reservationMaxDurationEnvKey           = "ISUCON13_RESERVATION_MAX_DURATION"
+	reservationMinLeadTimeEnvKey           = "ISUCON13_RESERVATION_MIN_LEAD_TIME"
+	reservationAlignToSlotEnvKey           = "ISUCON13_RESERVATION_ALIGN_TO_SLOT"
+
+	// 予約枠を一度に INSERT する件数
+	reservationSlotInsertBatchSize = 1000
+)
+
+// ReservationConfig は予約期間と予約枠の設定
+type ReservationConfig struct {
+	TermStartAt time.Time
+	TermEndAt   time.Time
+	// RollingHorizon が正の場合、予約期間の終わりは現在時刻からこの期間先まで延長される (0 で延長しない)
+	RollingHorizon time.Duration
+	// 予約枠1つあたりの長さ
+	SlotDuration time.Duration
+	// 予約枠1つあたりの予約可能数
+	SlotCapacity int64
+	// 予約時に検査するポリシー
+	Policy ReservationPolicy
+}
+
+var reservationConf = defaultReservationConfig()
+
+func defaultReservationConfig() ReservationConfig {
+	return ReservationConfig{
+		TermStartAt:  time.Date(2023, 11, 25, 1, 0, 0, 0, time.UTC),
+		TermEndAt:    time.Date(2024, 11, 25, 1, 0, 0, 0, time.UTC),
+		SlotDuration: time.Hour,
+		SlotCapacity: 5,
+	}
+}
+
+// loadReservationConfig は環境変数から予約の設定を読み込む
+// 日時は RFC3339 か UNIX 秒、期間は time.ParseDuration の形式で指定する
+func loadReservationConfig() (ReservationConfig, error) {
+	conf := defaultReservationConfig()
+
+	if v, ok := os.LookupEnv(reservationTermStartEnvKey); ok {
+		t, err := parseConfigTime(v)
+		if err != nil {
+			return conf, fmt.Errorf("failed to parse environment variable '%s': %w", reservationTermStartEnvKey, err)
+		}
+		conf.TermStartAt = t
+	}
+	if v, ok := os.LookupEnv(reservationTermEndEnvKey); ok {
+		t, err := parseConfigTime(v)
+		if err != nil {
+			return conf, fmt.Errorf("failed to parse environment variable '%s': %w", reservationTermEndEnvKey, err)
+		}
+		conf.TermEndAt = t
+	}
+	if v, ok := os.LookupEnv(reservationRollingHorizonEnvKey); ok {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			return conf, fmt.Errorf("environment variable '%s' must be a non-negative duration: %s", reservationRollingHorizonEnvKey, v)
+		}
+		conf.RollingHorizon = d
+	}
+	if v, ok := os.LookupEnv(reservationSlotDurationEnvKey); ok {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return conf, fmt.Errorf("environment variable '%s' must be a positive duration: %s", reservationSlotDurationEnvKey, v)
+		}
+		conf.SlotDuration = d
+	}
+	if v, ok := os.LookupEnv(reservationSlotCapacityEnvKey); ok {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 {
+			return conf, fmt.Errorf("environment variable '%s' must be a non-negative integer: %s", reservationSlotCapacityEnvKey, v)
+		}
+		conf.SlotCapacity = n
+	}
+
+	if v, ok := os.LookupEnv(reservationMaxFutureReservationsEnvKey); ok {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 {
+			return conf, fmt.Errorf("environment variable '%s' must be a non-negative integer: %s", reservationMaxFutureReservationsEnvKey, v)
+		}
+		conf.Policy.MaxFutureReservations = n
+	}
+	if v, ok := os.LookupEnv(reservationMaxDurationEnvKey); ok {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			return conf, fmt.Errorf("environment variable '%s' must be a non-negative duration: %s", reservationMaxDurationEnvKey, v)
+		}
+		conf.Policy.MaxDuration = d
+	}
+	if v, ok := os.LookupEnv(reservationMinLeadTimeEnvKey); ok {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			return conf, fmt.Errorf("environment variable '%s' must be a non-negative duration: %s", reservationMinLeadTimeEnvKey, v)
+		}
+		conf.Policy.MinLeadTime = d
+	}
+	if v, ok := os.LookupEnv(reservationAlignToSlotEnvKey); ok {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return conf, fmt.Errorf("failed to parse environment variable '%s': %w", reservationAlignToSlotEnvKey, err)
+		}
+		conf.Policy.AlignToSlot = b
+	}
+
+	if !conf.TermStartAt.Before(conf.TermEndAt) {
+		return conf, fmt.Errorf("reservation term start must be before its end")
+	}
+	return conf, nil
+}
+
+func parseConfigTime(v string) (time.Time, error) {
+	if unix, err := strconv.ParseInt(v, 10, 64); err == nil {
+		return time.Unix(unix, 0).UTC(), nil
+	}
+	return time.Parse(time.RFC3339, v)
+}
+
+// Term は現在時刻における予約期間を返す
+func (c ReservationConfig) Term(now time.Time) (time.Time, time.Time) {
+	endAt := c.TermEndAt
+	if c.RollingHorizon > 0 {
+		if rolling := now.Truncate(c.SlotDuration).Add(c.RollingHorizon); rolling.After(endAt) {
+			endAt = rolling
+		}
+	}
+	return c.TermStartAt, endAt
+}
+
+// MaxSlotsUntil は予約枠を作成できる上限の時刻を返す
+// 現在の予約期間の終わりから、さらにローリング期間の分だけ先まで作成できる
+func (c ReservationConfig) MaxSlotsUntil(now time.Time) time.Time {
+	_, termEndAt := c.Term(now)
+	return termEndAt.Add(c.RollingHorizon)
+}
+
+// generateReservationSlots は既存の予約枠の直後から until までの予約枠を作成し、作成した予約枠を返す
+// 予約枠がまだ無い場合は予約期間の始まりから作成する
+// 現在時刻より前の予約枠は作成せず、その場合は現在時刻を含む予約枠から作成する
+func generateReservationSlots(ctx context.Context, tx *sqlx.Tx, conf ReservationConfig, now, until time.Time) ([]ReservationSlotModel, error) {
+	var lastEndAt int64
+	if err := tx.GetContext(ctx, &lastEndAt, "SELECT IFNULL(MAX(end_at), 0) FROM reservation_slots FOR UPDATE"); err != nil {
+		return nil, err
+	}
+	startAt := conf.TermStartAt
+	if lastEndAt > 0 {
+		startAt = time.Unix(lastEndAt, 0)
+	}
+	if current := now.Truncate(conf.SlotDuration); current.After(startAt) {
+		startAt = current
+	}
+
+	step := int64(conf.SlotDuration / time.Second)
+	var slots []ReservationSlotModel
+	for s := startAt.Unix(); s+step <= until.Unix(); s += step {
+		slots = append(slots, ReservationSlotModel{
+			Slot:    conf.SlotCapacity,
+			StartAt: s,
+			EndAt:   s + step,
+		})
+	}
+	for i := 0; i < len(slots); i += reservationSlotInsertBatchSize {
+		batch := slots[i:min(i+reservationSlotInsertBatchSize, len(slots))]
+		if _, err := tx.NamedExecContext(ctx, "INSERT INTO reservation_slots (slot, start_at, end_at) VALUES (:slot, :start_at, :end_at)", batch); err != nil {
+			return nil, err
+		}
+	}
+	return slots, nil
+}
+
+// extendReservationSlots はローリング期間が設定されている場合に、予約期間の終わりまで予約枠を作成する
+func extendReservationSlots(ctx context.Context, db *sqlx.DB, conf ReservationConfig, now time.Time) (int, error) {
+	if conf.RollingHorizon <= 0 {
+		return 0, nil
+	}
+
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	_, termEndAt := conf.Term(now)
+	slots, err := generateReservationSlots(ctx, tx, conf, now, termEndAt)
+	if err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	slotAlloc.add(slots)
+	return len(slots), nil
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	availabilityGranularitySlot  = "slot"
+	availabilityGranularityRange = "range"
+
+	reservationCheckTerm          = "term"
+	reservationCheckTags          = "tags"
+	reservationCheckCollaborators = "collaborators"
+	reservationCheckPolicy        = "policy"
+	reservationCheckCapacity      = "capacity"
+)
+
+type ReservationAvailability struct {
+	From        int64  `json:"from"`
+	To          int64  `json:"to"`
+	Granularity string `json:"granularity"`
+	// granularity=slot の場合は予約枠ごと、granularity=range の場合はまとめた区間のみを返す
+	Slots  *[]ReservationSlotAvailability  `json:"slots,omitempty"`
+	Ranges *[]ReservationRangeAvailability `json:"ranges,omitempty"`
+}
+
+type ReservationSlotAvailability struct {
+	StartAt   int64 `json:"start_at"`
+	EndAt     int64 `json:"end_at"`
+	Remaining int64 `json:"remaining"`
+}
+
+// ReservationRangeAvailability は空きのある連続した予約枠をまとめたもの
+// MinRemaining はその区間をまとめて予約できる残数
+type ReservationRangeAvailability struct {
+	StartAt      int64 `json:"start_at"`
+	EndAt        int64 `json:"end_at"`
+	MinRemaining int64 `json:"min_remaining"`
+}
+
+// 予約枠の空き状況取得API
+// GET /api/reservation/availability?from=&to=&granularity=slot|range
+func getReservationAvailabilityHandler(c echo.Context) error {
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	from, err := strconv.ParseInt(c.QueryParam("from"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "from query parameter must be integer")
+	}
+	to, err := strconv.ParseInt(c.QueryParam("to"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "to query parameter must be integer")
+	}
+	if from >= to {
+		return echo.NewHTTPError(http.StatusBadRequest, "from must be before to")
+	}
+
+	granularity := c.QueryParam("granularity")
+	if granularity == "" {
+		granularity = availabilityGranularitySlot
+	}
+	if granularity != availabilityGranularitySlot && granularity != availabilityGranularityRange {
+		return echo.NewHTTPError(http.StatusBadRequest, "granularity query parameter must be one of slot, range")
+	}
+
+	// 残数はメモリ上のアロケータから読む
+	allocatorSlots := slotAlloc.slotsIn(from, to)
+	slots := make([]ReservationSlotAvailability, len(allocatorSlots))
+	for i, s := range allocatorSlots {
+		slots[i] = ReservationSlotAvailability{
+			StartAt:   s.startAt,
+			EndAt:     s.endAt,
+			Remaining: s.remaining.Load(),
+		}
+	}
+
+	availability := ReservationAvailability{
+		From:        from,
+		To:          to,
+		Granularity: granularity,
+	}
+	if granularity == availabilityGranularityRange {
+		ranges := mergeAvailableSlots(slots)
+		availability.Ranges = &ranges
+	} else {
+		availability.Slots = &slots
+	}
+
+	return c.JSON(http.StatusOK, availability)
+}
+
+// mergeAvailableSlots は start_at 順に並んだ予約枠のうち、空きがあって隣接しているものを1つの区間にまとめる
+func mergeAvailableSlots(slots []ReservationSlotAvailability) []ReservationRangeAvailability {
+	ranges := []ReservationRangeAvailability{}
+	for _, s := range slots {
+		if s.Remaining < 1 {
+			continue
+		}
+		if n := len(ranges); n > 0 && ranges[n-1].EndAt == s.StartAt {
+			ranges[n-1].EndAt = s.EndAt
+			ranges[n-1].MinRemaining = min(ranges[n-1].MinRemaining, s.Remaining)
+			continue
+		}
+		ranges = append(ranges, ReservationRangeAvailability{
+			StartAt:      s.StartAt,
+			EndAt:        s.EndAt,
+			MinRemaining: s.Remaining,
+		})
+	}
+	return ranges
+}
+
+// ReservationQuote は予約APIの dry_run の結果
+type ReservationQuote struct {
+	Reservable bool  `json:"reservable"`
+	StartAt    int64 `json:"start_at"`
+	EndAt      int64 `json:"end_at"`
+	// 予約した場合に消費される予約枠と、その現在の残数
+	Slots    []ReservationSlotAvailability `json:"slots"`
+	Failures []ReservationQuoteFailure     `json:"failures"`
+}
+
+type ReservationQuoteFailure struct {
+	// term, tags, policy, capacity
+	Check string `json:"check"`
+	// check が policy の場合に違反したポリシー
+	Policy  string `json:"policy,omitempty"`
+	Message string `json:"message"`
+}
+
+// quoteReservation は予約APIと同じ検査を、ロックを取らず書き込みもせずに行う
+// 予約APIとは異なり、最初の失敗で打ち切らずに全ての検査結果を返す
+func quoteReservation(ctx context.Context, userID int64, req *ReserveLivestreamRequest) (*ReservationQuote, error) {
+	quote := &ReservationQuote{
+		StartAt:  req.StartAt,
+		EndAt:    req.EndAt,
+		Slots:    []ReservationSlotAvailability{},
+		Failures: []ReservationQuoteFailure{},
+	}
+
+	if err := validateReservationTerm(req.StartAt, req.EndAt); err != nil {
+		termStartAt, termEndAt := reservationConf.Term(time.Now())
+		quote.Failures = append(quote.Failures, ReservationQuoteFailure{
+			Check:   reservationCheckTerm,
+			Message: fmt.Sprintf("reservation time range must overlap the reservation term %d ~ %d", termStartAt.Unix(), termEndAt.Unix()),
+		})
+	}
+
+	missing, err := missingTagIDs(ctx, dbConn, req.Tags)
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, "failed to get tags: "+err.Error())
+	}
+	if len(missing) > 0 {
+		quote.Failures = append(quote.Failures, ReservationQuoteFailure{
+			Check:   reservationCheckTags,
+			Message: fmt.Sprintf("tags not found: %v", missing),
+		})
+	}
+
+	if _, err := resolveCollaborators(ctx, dbConn, userID, req.Collaborators); err != nil {
+		var he *echo.HTTPError
+		if !errors.As(err, &he) || he.Code != http.StatusBadRequest {
+			return nil, err
+		}
+		quote.Failures = append(quote.Failures, ReservationQuoteFailure{
+			Check:   reservationCheckCollaborators,
+			Message: fmt.Sprint(he.Message),
+		})
+	}
+
+	now := time.Now()
+	ranges := []reservationRange{{startAt: req.StartAt, endAt: req.EndAt}}
+	violations := rangePolicyViolations(ranges, now)
+	v, err := reservationConf.Policy.quotaViolation(ctx, dbConn, userID, int64(len(ranges)), now)
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, "failed to count reservations: "+err.Error())
+	}
+	if v != nil {
+		violations = append(violations, *v)
+	}
+	for _, v := range violations {
+		quote.Failures = append(quote.Failures, ReservationQuoteFailure{
+			Check:   reservationCheckPolicy,
+			Policy:  v.Policy,
+			Message: v.Message,
+		})
+	}
+
+	// 残数はメモリ上のアロケータから読む
+	for _, s := range slotAlloc.slotsIn(req.StartAt, req.EndAt) {
+		remaining := s.remaining.Load()
+		quote.Slots = append(quote.Slots, ReservationSlotAvailability{
+			StartAt:   s.startAt,
+			EndAt:     s.endAt,
+			Remaining: remaining,
+		})
+		if remaining < 1 {
+			quote.Failures = append(quote.Failures, ReservationQuoteFailure{
+				Check:   reservationCheckCapacity,
+				Message: fmt.Sprintf("reservation slot %d ~ %d is full", s.startAt, s.endAt),
+			})
+		}
+	}
+
+	quote.Reservable = len(quote.Failures) == 0
+	return quote, nil
+}
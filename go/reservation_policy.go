@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	reservationPolicyMaxFutureReservations = "max_future_reservations"
+	reservationPolicyMaxDuration           = "max_duration"
+	reservationPolicyMinLeadTime           = "min_lead_time"
+	reservationPolicyAlignToSlot           = "align_to_slot"
+)
+
+// ReservationPolicy は予約時に検査する制約。ゼロ値の項目は検査しない
+type ReservationPolicy struct {
+	// 1ユーザが持てる開始前の予約の数
+	MaxFutureReservations int64
+	// 1配信あたりの最大の長さ
+	MaxDuration time.Duration
+	// 予約時刻から配信開始までに空けるべき期間
+	MinLeadTime time.Duration
+	// 予約区間の始まりと終わりを予約枠の境界に揃えることを求める
+	AlignToSlot bool
+}
+
+type ReservationPolicyViolation struct {
+	Policy  string `json:"policy"`
+	Message string `json:"message"`
+}
+
+type ReservationPolicyErrorResponse struct {
+	Error      string                       `json:"error"`
+	Violations []ReservationPolicyViolation `json:"violations"`
+}
+
+// errReservationPolicyViolated は予約ポリシーを満たさないことを表す
+var errReservationPolicyViolated = errors.New("reservation policy violated")
+
+func reservationPolicyError(violations []ReservationPolicyViolation) error {
+	return echo.NewHTTPError(http.StatusBadRequest, &ReservationPolicyErrorResponse{
+		Error:      "the reservation violates reservation policies",
+		Violations: violations,
+	}).SetInternal(errReservationPolicyViolated)
+}
+
+// violations は予約区間そのものに対する制約を検査する
+func (p ReservationPolicy) violations(conf ReservationConfig, startAt, endAt int64, now time.Time) []ReservationPolicyViolation {
+	var violations []ReservationPolicyViolation
+	if p.MaxDuration > 0 && endAt-startAt > int64(p.MaxDuration/time.Second) {
+		violations = append(violations, ReservationPolicyViolation{
+			Policy:  reservationPolicyMaxDuration,
+			Message: fmt.Sprintf("livestream duration must be at most %s", p.MaxDuration),
+		})
+	}
+	if p.MinLeadTime > 0 && startAt < now.Add(p.MinLeadTime).Unix() {
+		violations = append(violations, ReservationPolicyViolation{
+			Policy:  reservationPolicyMinLeadTime,
+			Message: fmt.Sprintf("livestream must be reserved at least %s before it starts", p.MinLeadTime),
+		})
+	}
+	if p.AlignToSlot {
+		base := conf.TermStartAt.Unix()
+		step := int64(conf.SlotDuration / time.Second)
+		if (startAt-base)%step != 0 || (endAt-base)%step != 0 {
+			violations = append(violations, ReservationPolicyViolation{
+				Policy:  reservationPolicyAlignToSlot,
+				Message: fmt.Sprintf("start_at and end_at must be aligned to %s slot boundaries", conf.SlotDuration),
+			})
+		}
+	}
+	return violations
+}
+
+// quotaViolation はユーザの開始前の予約が adding 件増えても上限を超えないかを検査する
+func (p ReservationPolicy) quotaViolation(ctx context.Context, q sqlx.QueryerContext, userID int64, adding int64, now time.Time) (*ReservationPolicyViolation, error) {
+	if p.MaxFutureReservations <= 0 {
+		return nil, nil
+	}
+	var count int64
+	if err := sqlx.GetContext(ctx, q, &count, "SELECT COUNT(*) FROM livestreams WHERE user_id = ? AND start_at > ?", userID, now.Unix()); err != nil {
+		return nil, err
+	}
+	if count+adding <= p.MaxFutureReservations {
+		return nil, nil
+	}
+	return &ReservationPolicyViolation{
+		Policy:  reservationPolicyMaxFutureReservations,
+		Message: fmt.Sprintf("a user can have at most %d upcoming reservations", p.MaxFutureReservations),
+	}, nil
+}
+
+// checkReservationPolicy は新たに予約する区間が予約ポリシーを満たすかを検査する
+// 同じユーザの予約が並行して上限を超えないよう、呼び出し側で lockUserForReservation しておく
+func checkReservationPolicy(ctx context.Context, q sqlx.QueryerContext, userID int64, ranges []reservationRange, now time.Time) error {
+	violations := rangePolicyViolations(ranges, now)
+
+	v, err := reservationConf.Policy.quotaViolation(ctx, q, userID, int64(len(ranges)), now)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to count reservations: "+err.Error())
+	}
+	if v != nil {
+		violations = append(violations, *v)
+	}
+
+	if len(violations) > 0 {
+		return reservationPolicyError(violations)
+	}
+	return nil
+}
+
+// checkReschedulePolicy は予約区間の変更が予約ポリシーを満たすかを検査する (予約数は変わらないので上限は検査しない)
+func checkReschedulePolicy(ranges []reservationRange, now time.Time) error {
+	if violations := rangePolicyViolations(ranges, now); len(violations) > 0 {
+		return reservationPolicyError(violations)
+	}
+	return nil
+}
+
+// rangePolicyViolations は各予約区間の違反を、ポリシーごとに1つにまとめて返す
+func rangePolicyViolations(ranges []reservationRange, now time.Time) []ReservationPolicyViolation {
+	var violations []ReservationPolicyViolation
+	seen := make(map[string]struct{})
+	for _, rr := range ranges {
+		for _, v := range reservationConf.Policy.violations(reservationConf, rr.startAt, rr.endAt, now) {
+			if _, ok := seen[v.Policy]; ok {
+				continue
+			}
+			seen[v.Policy] = struct{}{}
+			violations = append(violations, v)
+		}
+	}
+	return violations
+}
+
+// lockUserForReservation は予約数の上限を検査する間、同じユーザの予約を直列化する
+func lockUserForReservation(ctx context.Context, tx *sqlx.Tx, userID int64) error {
+	if reservationConf.Policy.MaxFutureReservations <= 0 {
+		return nil
+	}
+	var id int64
+	if err := tx.GetContext(ctx, &id, "SELECT id FROM users WHERE id = ? FOR UPDATE", userID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "user not found")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to lock user: "+err.Error())
+	}
+	return nil
+}
@@ -0,0 +1,558 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	recurrenceFrequencyDaily  = "daily"
+	recurrenceFrequencyWeekly = "weekly"
+
+	// 1つの系列で作成できる配信数の上限
+	maxRecurrenceCount = 100
+
+	reservationConflictOutOfTerm   = "out_of_term"
+	reservationConflictUnavailable = "unavailable"
+)
+
+type RecurrenceRule struct {
+	// daily, weekly
+	Frequency string `json:"frequency"`
+	// 何日 (週) おきか。省略時は 1
+	Interval int64 `json:"interval"`
+	// 初回を含めた配信数
+	Count int64 `json:"count"`
+}
+
+// ReserveLivestreamSeriesRequest の start_at, end_at は初回の配信の予約区間
+type ReserveLivestreamSeriesRequest struct {
+	ReserveLivestreamRequest
+	Recurrence RecurrenceRule `json:"recurrence"`
+}
+
+type LivestreamSeriesModel struct {
+	ID            int64  `db:"id"`
+	UserID        int64  `db:"user_id"`
+	Frequency     string `db:"frequency"`
+	IntervalCount int64  `db:"interval_count"`
+	Occurrences   int64  `db:"occurrences"`
+	CreatedAt     int64  `db:"created_at"`
+}
+
+type LivestreamSeriesMemberModel struct {
+	ID           int64 `db:"id"`
+	SeriesID     int64 `db:"series_id"`
+	LivestreamID int64 `db:"livestream_id"`
+}
+
+type LivestreamSeries struct {
+	ID          int64          `json:"id"`
+	Recurrence  RecurrenceRule `json:"recurrence"`
+	Livestreams []Livestream   `json:"livestreams"`
+}
+
+// ReservationConflict は予約できなかった回
+type ReservationConflict struct {
+	// 系列内での順番 (0始まり)
+	Index   int    `json:"index"`
+	StartAt int64  `json:"start_at"`
+	EndAt   int64  `json:"end_at"`
+	Reason  string `json:"reason"`
+}
+
+type ReservationConflictResponse struct {
+	Error     string                `json:"error"`
+	Conflicts []ReservationConflict `json:"conflicts"`
+}
+
+func reservationConflictError(conflicts []ReservationConflict) error {
+	return echo.NewHTTPError(http.StatusBadRequest, &ReservationConflictResponse{
+		Error:     "some occurrences can't be reserved",
+		Conflicts: conflicts,
+	})
+}
+
+// occurrences は初回の予約区間から繰り返し規則に従って各回の予約区間を求める
+func (r RecurrenceRule) occurrences(startAt, endAt int64) []reservationRange {
+	days := int(r.Interval)
+	if r.Frequency == recurrenceFrequencyWeekly {
+		days *= 7
+	}
+	ranges := make([]reservationRange, r.Count)
+	for i := range ranges {
+		start := time.Unix(startAt, 0).AddDate(0, 0, days*i)
+		end := time.Unix(endAt, 0).AddDate(0, 0, days*i)
+		ranges[i] = reservationRange{startAt: start.Unix(), endAt: end.Unix()}
+	}
+	return ranges
+}
+
+func (r *RecurrenceRule) validate() error {
+	if r.Frequency != recurrenceFrequencyDaily && r.Frequency != recurrenceFrequencyWeekly {
+		return echo.NewHTTPError(http.StatusBadRequest, "recurrence.frequency must be one of daily, weekly")
+	}
+	if r.Interval == 0 {
+		r.Interval = 1
+	}
+	if r.Interval < 1 {
+		return echo.NewHTTPError(http.StatusBadRequest, "recurrence.interval must be positive integer")
+	}
+	if r.Count < 1 || r.Count > maxRecurrenceCount {
+		return echo.NewHTTPError(http.StatusBadRequest, "recurrence.count must be between 1 and "+strconv.Itoa(maxRecurrenceCount))
+	}
+	return nil
+}
+
+// slotsConflict は枠が予約区間に含まれるかを判定する (slotsIn と同じ条件)
+func slotsConflict(failed []*allocatorSlot, rr reservationRange) bool {
+	for _, s := range failed {
+		if s.startAt >= rr.startAt && s.endAt <= rr.endAt {
+			return true
+		}
+	}
+	return false
+}
+
+// 繰り返し予約API
+// 全ての回の予約枠を確保できた場合のみまとめて作成し、確保できない回があればそれらを返す
+// POST /api/livestream/reservation/series
+func reserveLivestreamSeriesHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	var req *ReserveLivestreamSeriesRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+	if req.StartAt >= req.EndAt {
+		return echo.NewHTTPError(http.StatusBadRequest, "start_at must be before end_at")
+	}
+	if err := req.Recurrence.validate(); err != nil {
+		return err
+	}
+	ranges := req.Recurrence.occurrences(req.StartAt, req.EndAt)
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	if err := validateTagIDs(ctx, tx, req.Tags); err != nil {
+		return err
+	}
+	if err := lockUserForReservation(ctx, tx, userID); err != nil {
+		return err
+	}
+	if err := checkReservationPolicy(ctx, tx, userID, ranges, time.Now()); err != nil {
+		return err
+	}
+
+	sr := newSlotReservation()
+	defer sr.Rollback()
+	if err := acquireSeriesSlots(ctx, tx, sr, nil, ranges); err != nil {
+		return err
+	}
+
+	seriesModel := LivestreamSeriesModel{
+		UserID:        userID,
+		Frequency:     req.Recurrence.Frequency,
+		IntervalCount: req.Recurrence.Interval,
+		Occurrences:   req.Recurrence.Count,
+		CreatedAt:     time.Now().Unix(),
+	}
+	rs, err := tx.NamedExecContext(ctx, "INSERT INTO livestream_series (user_id, frequency, interval_count, occurrences, created_at) VALUES (:user_id, :frequency, :interval_count, :occurrences, :created_at)", &seriesModel)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert livestream series: "+err.Error())
+	}
+	seriesID, err := rs.LastInsertId()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get last inserted livestream series id: "+err.Error())
+	}
+	seriesModel.ID = seriesID
+
+	livestreamModels := make([]LivestreamModel, len(ranges))
+	members := make([]LivestreamSeriesMemberModel, len(ranges))
+	for i, rr := range ranges {
+		occurrence := req.ReserveLivestreamRequest
+		occurrence.StartAt = rr.startAt
+		occurrence.EndAt = rr.endAt
+		livestreamModel, err := insertReservedLivestream(ctx, tx, userID, &occurrence)
+		if err != nil {
+			return err
+		}
+		livestreamModels[i] = livestreamModel
+		members[i] = LivestreamSeriesMemberModel{
+			SeriesID:     seriesID,
+			LivestreamID: livestreamModel.ID,
+		}
+	}
+	if _, err := tx.NamedExecContext(ctx, "INSERT INTO livestream_series_members (series_id, livestream_id) VALUES (:series_id, :livestream_id)", members); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert livestream series members: "+err.Error())
+	}
+
+	series, err := fillLivestreamSeriesResponse(ctx, tx, seriesModel, livestreamModels)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestream series: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+	sr.Commit()
+
+	return c.JSON(http.StatusCreated, series)
+}
+
+// acquireSeriesSlots は系列の各回を olds から news の予約区間へ付け替える (新規作成時は olds が nil)
+// 予約期間外の回や予約枠が足りない回があれば、それらを全て列挙したエラーを返す
+func acquireSeriesSlots(ctx context.Context, tx *sqlx.Tx, sr *slotReservation, olds, news []reservationRange) error {
+	var conflicts []ReservationConflict
+	for i, rr := range news {
+		if err := validateReservationTerm(rr.startAt, rr.endAt); err != nil {
+			conflicts = append(conflicts, ReservationConflict{Index: i, StartAt: rr.startAt, EndAt: rr.endAt, Reason: reservationConflictOutOfTerm})
+		}
+	}
+	if len(conflicts) > 0 {
+		return reservationConflictError(conflicts)
+	}
+
+	if failed := sr.rescheduleAll(olds, news); len(failed) > 0 {
+		for i, rr := range news {
+			if slotsConflict(failed, rr) {
+				conflicts = append(conflicts, ReservationConflict{Index: i, StartAt: rr.startAt, EndAt: rr.endAt, Reason: reservationConflictUnavailable})
+			}
+		}
+		return reservationConflictError(conflicts)
+	}
+
+	// 旧区間を全て返却してから新区間を確保する
+	for _, rr := range olds {
+		if err := releaseReservationSlotsInDB(ctx, tx, rr.startAt, rr.endAt); err != nil {
+			return err
+		}
+	}
+	for i, rr := range news {
+		if err := acquireReservationSlotsInDB(ctx, tx, rr.startAt, rr.endAt); err != nil {
+			if !isReservationUnavailable(err) {
+				return err
+			}
+			conflicts = append(conflicts, ReservationConflict{Index: i, StartAt: rr.startAt, EndAt: rr.endAt, Reason: reservationConflictUnavailable})
+		}
+	}
+	if len(conflicts) > 0 {
+		return reservationConflictError(conflicts)
+	}
+	return nil
+}
+
+// 繰り返し予約の取得API
+// GET /api/livestream/series/:series_id
+func getLivestreamSeriesHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	seriesID, err := strconv.Atoi(c.Param("series_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "series_id in path must be integer")
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	var seriesModel LivestreamSeriesModel
+	if err := tx.GetContext(ctx, &seriesModel, "SELECT * FROM livestream_series WHERE id = ?", seriesID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "livestream series not found")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream series: "+err.Error())
+	}
+
+	var livestreamModels []LivestreamModel
+	if err := tx.SelectContext(ctx, &livestreamModels, "SELECT l.* FROM livestreams l INNER JOIN livestream_series_members m ON m.livestream_id = l.id WHERE m.series_id = ? ORDER BY l.start_at", seriesModel.ID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
+	}
+
+	series, err := fillLivestreamSeriesResponse(ctx, tx, seriesModel, livestreamModels)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestream series: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, series)
+}
+
+// UpdateLivestreamSeriesRequest は未開始の回をまとめて編集する
+type UpdateLivestreamSeriesRequest struct {
+	Tags         *[]int64 `json:"tags"`
+	Title        *string  `json:"title"`
+	Description  *string  `json:"description"`
+	PlaylistUrl  *string  `json:"playlist_url"`
+	ThumbnailUrl *string  `json:"thumbnail_url"`
+	// 各回の予約区間をずらす秒数
+	Shift *int64 `json:"shift"`
+}
+
+// 繰り返し予約の一括編集API
+// 開始前の回のみを対象とし、ずらした結果予約できない回があれば何も変更せずにそれらを返す
+// PATCH /api/livestream/series/:series_id
+func updateLivestreamSeriesHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	seriesID, err := strconv.Atoi(c.Param("series_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "series_id in path must be integer")
+	}
+
+	var req *UpdateLivestreamSeriesRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	seriesModel, upcoming, err := getOwnedUpcomingSeriesForUpdate(ctx, tx, int64(seriesID), userID)
+	if err != nil {
+		return err
+	}
+
+	var tagIDs []int64
+	if req.Tags != nil {
+		tagIDs = uniqueTagIDs(*req.Tags)
+		if err := validateTagIDs(ctx, tx, tagIDs); err != nil {
+			return err
+		}
+	}
+
+	sr := newSlotReservation()
+	defer sr.Rollback()
+	olds := make([]reservationRange, len(upcoming))
+	for i, l := range upcoming {
+		olds[i] = reservationRange{startAt: l.StartAt, endAt: l.EndAt}
+	}
+	shifted := req.Shift != nil && *req.Shift != 0
+	if shifted {
+		news := make([]reservationRange, len(olds))
+		for i, rr := range olds {
+			news[i] = reservationRange{startAt: rr.startAt + *req.Shift, endAt: rr.endAt + *req.Shift}
+		}
+		if err := checkReschedulePolicy(news, time.Now()); err != nil {
+			return err
+		}
+		if err := acquireSeriesSlots(ctx, tx, sr, olds, news); err != nil {
+			return err
+		}
+		for i := range upcoming {
+			upcoming[i].StartAt = news[i].startAt
+			upcoming[i].EndAt = news[i].endAt
+		}
+	}
+
+	for i := range upcoming {
+		livestreamModel := &upcoming[i]
+		if req.Title != nil {
+			livestreamModel.Title = *req.Title
+		}
+		if req.Description != nil {
+			livestreamModel.Description = *req.Description
+		}
+		if req.PlaylistUrl != nil {
+			livestreamModel.PlaylistUrl = *req.PlaylistUrl
+		}
+		if req.ThumbnailUrl != nil {
+			livestreamModel.ThumbnailUrl = *req.ThumbnailUrl
+		}
+		if _, err := tx.NamedExecContext(ctx, "UPDATE livestreams SET title = :title, description = :description, playlist_url = :playlist_url, thumbnail_url = :thumbnail_url, start_at = :start_at, end_at = :end_at WHERE id = :id", livestreamModel); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to update livestream: "+err.Error())
+		}
+		if req.Tags != nil {
+			if err := replaceLivestreamTags(ctx, tx, livestreamModel.ID, tagIDs); err != nil {
+				return err
+			}
+		}
+	}
+
+	series, err := fillLivestreamSeriesResponse(ctx, tx, seriesModel, upcoming)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestream series: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+	sr.Commit()
+
+	// 旧区間で空いた枠をキャンセル待ちに回す
+	if shifted {
+		for _, rr := range olds {
+			if err := processReservationWaitlist(ctx, rr.startAt, rr.endAt); err != nil {
+				c.Logger().Warnf("failed to process reservation waitlist: %v", err)
+			}
+		}
+	}
+
+	return c.JSON(http.StatusOK, series)
+}
+
+// 繰り返し予約の一括キャンセルAPI
+// 開始前の回をまとめてキャンセルし、予約枠を返却する
+// DELETE /api/livestream/series/:series_id
+func cancelLivestreamSeriesHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	seriesID, err := strconv.Atoi(c.Param("series_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "series_id in path must be integer")
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	seriesModel, upcoming, err := getOwnedUpcomingSeriesForUpdate(ctx, tx, int64(seriesID), userID)
+	if err != nil {
+		return err
+	}
+
+	sr := newSlotReservation()
+	defer sr.Rollback()
+	livestreamIDs := make([]int64, len(upcoming))
+	for i, l := range upcoming {
+		if err := releaseReservationSlots(ctx, tx, sr, l.StartAt, l.EndAt); err != nil {
+			return err
+		}
+		livestreamIDs[i] = l.ID
+	}
+
+	if len(livestreamIDs) > 0 {
+		for _, q := range []string{
+			"DELETE FROM livestream_tags WHERE livestream_id IN (?)",
+			"DELETE FROM livestreams WHERE id IN (?)",
+			"DELETE FROM livestream_series_members WHERE livestream_id IN (?)",
+			"DELETE FROM livestream_collaborators WHERE livestream_id IN (?)",
+			"DELETE FROM bookmarks WHERE livestream_id IN (?)",
+		} {
+			query, params, err := sqlx.In(q, livestreamIDs)
+			if err != nil {
+				return echo.NewHTTPError(http.StatusInternalServerError, "failed to construct IN query: "+err.Error())
+			}
+			if _, err := tx.ExecContext(ctx, query, params...); err != nil {
+				return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete livestreams: "+err.Error())
+			}
+		}
+	}
+
+	// 開始済みの回が残っていなければ系列ごと削除する
+	var remaining int64
+	if err := tx.GetContext(ctx, &remaining, "SELECT COUNT(*) FROM livestream_series_members WHERE series_id = ?", seriesModel.ID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to count livestream series members: "+err.Error())
+	}
+	if remaining == 0 {
+		if _, err := tx.ExecContext(ctx, "DELETE FROM livestream_series WHERE id = ?", seriesModel.ID); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete livestream series: "+err.Error())
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+	sr.Commit()
+
+	// 空いた枠をキャンセル待ちに回す
+	for _, l := range upcoming {
+		if err := processReservationWaitlist(ctx, l.StartAt, l.EndAt); err != nil {
+			c.Logger().Warnf("failed to process reservation waitlist: %v", err)
+		}
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// getOwnedUpcomingSeriesForUpdate は配信者本人の系列と、そのうち開始前の回を行ロック付きで取得する
+func getOwnedUpcomingSeriesForUpdate(ctx context.Context, tx *sqlx.Tx, seriesID, userID int64) (LivestreamSeriesModel, []LivestreamModel, error) {
+	var seriesModel LivestreamSeriesModel
+	if err := tx.GetContext(ctx, &seriesModel, "SELECT * FROM livestream_series WHERE id = ? FOR UPDATE", seriesID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return LivestreamSeriesModel{}, nil, echo.NewHTTPError(http.StatusNotFound, "livestream series not found")
+		}
+		return LivestreamSeriesModel{}, nil, echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream series: "+err.Error())
+	}
+	if seriesModel.UserID != userID {
+		return LivestreamSeriesModel{}, nil, echo.NewHTTPError(http.StatusForbidden, "can't modify other streamer's livestream series")
+	}
+
+	var livestreamModels []LivestreamModel
+	if err := tx.SelectContext(ctx, &livestreamModels, "SELECT l.* FROM livestreams l INNER JOIN livestream_series_members m ON m.livestream_id = l.id WHERE m.series_id = ? AND l.start_at > ? ORDER BY l.start_at FOR UPDATE", seriesModel.ID, time.Now().Unix()); err != nil {
+		return LivestreamSeriesModel{}, nil, echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
+	}
+	return seriesModel, livestreamModels, nil
+}
+
+func fillLivestreamSeriesResponse(ctx context.Context, tx *sqlx.Tx, seriesModel LivestreamSeriesModel, livestreamModels []LivestreamModel) (LivestreamSeries, error) {
+	livestreams, err := fillLivestreamsResponse(ctx, tx, livestreamModels)
+	if err != nil {
+		return LivestreamSeries{}, err
+	}
+	return LivestreamSeries{
+		ID: seriesModel.ID,
+		Recurrence: RecurrenceRule{
+			Frequency: seriesModel.Frequency,
+			Interval:  seriesModel.IntervalCount,
+			Count:     seriesModel.Occurrences,
+		},
+		Livestreams: livestreams,
+	}, nil
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// 予約枠の残数をメモリ上で管理するアロケータ
+//
+// 残数は枠ごとの atomic.Int64 で持ち、CAS で 0 未満にならないよう減算するため、予約処理はロックを取らない
+// 枠の集合は start_at 順のスライスで持ち、枠の追加時はコピーして atomic.Pointer を差し替える
+// reservation_slots テーブルは永続化された記録で、更新時には slot > 0 の条件付きで減算して二重に検査する
+//
+// 残数はプロセスごとに持つため、アプリケーションは1インスタンスで動かすことを前提とする
+// 複数インスタンスで動かすと他のインスタンスの予約が残数に反映されない。テーブル側の検査で overbooking にはならないが、
+// メモリ上では空いているのに予約できない枠が残り、空き状況カレンダーの残数も実際とずれる。ずれは再起動か初期化で解消する
+var slotAlloc = &slotAllocator{}
+
+type allocatorSlot struct {
+	startAt   int64
+	endAt     int64
+	remaining atomic.Int64
+}
+
+type slotIndex struct {
+	slots []*allocatorSlot
+}
+
+type slotAllocator struct {
+	index atomic.Pointer[slotIndex]
+	// 枠の集合の差し替えのみ直列化する
+	mu sync.Mutex
+}
+
+// load は予約枠の集合を丸ごと置き換える
+func (a *slotAllocator) load(models []ReservationSlotModel) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	slots := make([]*allocatorSlot, len(models))
+	for i, m := range models {
+		slots[i] = &allocatorSlot{startAt: m.StartAt, endAt: m.EndAt}
+		slots[i].remaining.Store(m.Slot)
+	}
+	sort.Slice(slots, func(i, j int) bool { return slots[i].startAt < slots[j].startAt })
+	a.index.Store(&slotIndex{slots: slots})
+}
+
+// add は予約枠を追加する。既存の枠の残数はそのまま引き継ぐ
+func (a *slotAllocator) add(models []ReservationSlotModel) {
+	if len(models) == 0 {
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	var current []*allocatorSlot
+	if idx := a.index.Load(); idx != nil {
+		current = idx.slots
+	}
+	exists := make(map[int64]struct{}, len(current))
+	for _, s := range current {
+		exists[s.startAt] = struct{}{}
+	}
+
+	slots := make([]*allocatorSlot, len(current), len(current)+len(models))
+	copy(slots, current)
+	for _, m := range models {
+		if _, ok := exists[m.StartAt]; ok {
+			continue
+		}
+		s := &allocatorSlot{startAt: m.StartAt, endAt: m.EndAt}
+		s.remaining.Store(m.Slot)
+		slots = append(slots, s)
+	}
+	sort.Slice(slots, func(i, j int) bool { return slots[i].startAt < slots[j].startAt })
+	a.index.Store(&slotIndex{slots: slots})
+}
+
+// slotsIn は start_at >= startAt かつ end_at <= endAt の枠を返す (reservation_slots に対する検索条件と同じ)
+func (a *slotAllocator) slotsIn(startAt, endAt int64) []*allocatorSlot {
+	idx := a.index.Load()
+	if idx == nil {
+		return nil
+	}
+	i := sort.Search(len(idx.slots), func(i int) bool { return idx.slots[i].startAt >= startAt })
+	var slots []*allocatorSlot
+	for ; i < len(idx.slots) && idx.slots[i].startAt < endAt; i++ {
+		if idx.slots[i].endAt <= endAt {
+			slots = append(slots, idx.slots[i])
+		}
+	}
+	return slots
+}
+
+// tryAcquireSlots は全ての枠を1つずつ減算する。残数のない枠があれば減算済みの枠を戻して false を返す
+func tryAcquireSlots(slots []*allocatorSlot) bool {
+	for i, s := range slots {
+		for {
+			remaining := s.remaining.Load()
+			if remaining < 1 {
+				releaseSlots(slots[:i])
+				return false
+			}
+			if s.remaining.CompareAndSwap(remaining, remaining-1) {
+				break
+			}
+		}
+	}
+	return true
+}
+
+func releaseSlots(slots []*allocatorSlot) {
+	for _, s := range slots {
+		s.remaining.Add(1)
+	}
+}
+
+// adjustSlots は枠の容量変更を残数に反映する。残数は 0 未満にしない (reservation_slots の GREATEST(slot + ?, 0) と同じ)
+func adjustSlots(slots []*allocatorSlot, delta int64) {
+	for _, s := range slots {
+		for {
+			remaining := s.remaining.Load()
+			if s.remaining.CompareAndSwap(remaining, max(remaining+delta, 0)) {
+				break
+			}
+		}
+	}
+}
+
+// slotReservation は1トランザクション内での予約枠の増減をメモリ上に反映する
+//
+// 確保は即座に反映し、コミットされなかった場合は Rollback で戻す
+// 返却は他のリクエストが先に確保してしまわないよう、Commit まで反映を遅らせる
+type slotReservation struct {
+	acquired []*allocatorSlot
+	released []*allocatorSlot
+	done     bool
+}
+
+func newSlotReservation() *slotReservation {
+	return &slotReservation{}
+}
+
+// acquire は区間内の枠を確保する。確保できなければ false を返す
+func (r *slotReservation) acquire(startAt, endAt int64) bool {
+	slots := slotAlloc.slotsIn(startAt, endAt)
+	if !tryAcquireSlots(slots) {
+		return false
+	}
+	r.acquired = append(r.acquired, slots...)
+	return true
+}
+
+// release は区間内の枠をコミット時に返却する
+func (r *slotReservation) release(startAt, endAt int64) {
+	r.released = append(r.released, slotAlloc.slotsIn(startAt, endAt)...)
+}
+
+// reschedule は旧区間から新区間へ枠を付け替える
+// 両方の区間に含まれる枠はそのまま使い続けるので、満席の枠と重なる区間へのずらしも可能
+func (r *slotReservation) reschedule(oldStartAt, oldEndAt, newStartAt, newEndAt int64) bool {
+	oldSlots := slotAlloc.slotsIn(oldStartAt, oldEndAt)
+	newSlots := slotAlloc.slotsIn(newStartAt, newEndAt)
+
+	oldSet := make(map[*allocatorSlot]struct{}, len(oldSlots))
+	for _, s := range oldSlots {
+		oldSet[s] = struct{}{}
+	}
+	newSet := make(map[*allocatorSlot]struct{}, len(newSlots))
+	var toAcquire []*allocatorSlot
+	for _, s := range newSlots {
+		newSet[s] = struct{}{}
+		if _, ok := oldSet[s]; !ok {
+			toAcquire = append(toAcquire, s)
+		}
+	}
+
+	if !tryAcquireSlots(toAcquire) {
+		return false
+	}
+	r.acquired = append(r.acquired, toAcquire...)
+	for _, s := range oldSlots {
+		if _, ok := newSet[s]; !ok {
+			r.released = append(r.released, s)
+		}
+	}
+	return true
+}
+
+// reservationRange は予約区間 [startAt, endAt)
+type reservationRange struct {
+	startAt int64
+	endAt   int64
+}
+
+// rescheduleAll は複数の予約区間の付け替えをまとめて行う
+// 枠ごとに増減を相殺してから確保するので、同じ系列の配信同士で枠を譲り合うずらしも可能
+// 確保できない枠があれば何も確保せず、それらの枠を返す
+func (r *slotReservation) rescheduleAll(olds, news []reservationRange) []*allocatorSlot {
+	need := make(map[*allocatorSlot]int64)
+	for _, rr := range news {
+		for _, s := range slotAlloc.slotsIn(rr.startAt, rr.endAt) {
+			need[s]++
+		}
+	}
+	for _, rr := range olds {
+		for _, s := range slotAlloc.slotsIn(rr.startAt, rr.endAt) {
+			need[s]--
+		}
+	}
+
+	var acquired, released, failed []*allocatorSlot
+	for s, n := range need {
+		if n < 0 {
+			for ; n < 0; n++ {
+				released = append(released, s)
+			}
+			continue
+		}
+		slots := make([]*allocatorSlot, n)
+		for i := range slots {
+			slots[i] = s
+		}
+		if !tryAcquireSlots(slots) {
+			failed = append(failed, s)
+			continue
+		}
+		acquired = append(acquired, slots...)
+	}
+	if len(failed) > 0 {
+		releaseSlots(acquired)
+		return failed
+	}
+
+	r.acquired = append(r.acquired, acquired...)
+	r.released = append(r.released, released...)
+	return nil
+}
+
+// Commit はトランザクションのコミット後に呼び、返却を反映する
+func (r *slotReservation) Commit() {
+	if r.done {
+		return
+	}
+	r.done = true
+	releaseSlots(r.released)
+}
+
+// Rollback はコミットされなかった場合に確保を戻す。Commit 後に呼んでも何もしない
+func (r *slotReservation) Rollback() {
+	if r.done {
+		return
+	}
+	r.done = true
+	releaseSlots(r.acquired)
+}
+
+// loadSlotAllocator は reservation_slots の内容でアロケータを初期化する
+func loadSlotAllocator(ctx context.Context, db *sqlx.DB) error {
+	var slots []ReservationSlotModel
+	if err := db.SelectContext(ctx, &slots, "SELECT * FROM reservation_slots"); err != nil {
+		return err
+	}
+	slotAlloc.load(slots)
+	return nil
+}
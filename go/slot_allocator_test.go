@@ -0,0 +1,155 @@
+package main
+
+import (
+	"math/rand"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// 少数の枠に対して多数の goroutine が確保・返却・付け替えを繰り返しても、
+// 残数が 0 未満にならず、容量を超えて確保されず、最後には初期値に戻ることを確かめる
+func TestSlotReservationConcurrent(t *testing.T) {
+	const (
+		numSlots   = 3
+		capacity   = 4
+		step       = 3600
+		goroutines = 64
+		iterations = 500
+	)
+
+	models := make([]ReservationSlotModel, numSlots)
+	for i := range models {
+		models[i] = ReservationSlotModel{Slot: capacity, StartAt: int64(i * step), EndAt: int64((i + 1) * step)}
+	}
+	slotAlloc.load(models)
+	t.Cleanup(func() { slotAlloc.load(nil) })
+
+	slots := slotAlloc.slotsIn(0, numSlots*step)
+	if len(slots) != numSlots {
+		t.Fatalf("slotsIn returned %d slots, want %d", len(slots), numSlots)
+	}
+	// 確保が成功してから返却を反映するまでの間、保持している数
+	var held [numSlots]atomic.Int64
+	slotNumber := func(s *allocatorSlot) int { return int(s.startAt / step) }
+
+	hold := func(rr reservationRange) {
+		for _, s := range slotAlloc.slotsIn(rr.startAt, rr.endAt) {
+			if n := held[slotNumber(s)].Add(1); n > capacity {
+				t.Errorf("slot %d is held %d times, over capacity %d", slotNumber(s), n, capacity)
+			}
+		}
+	}
+	unhold := func(rr reservationRange) {
+		for _, s := range slotAlloc.slotsIn(rr.startAt, rr.endAt) {
+			held[slotNumber(s)].Add(-1)
+		}
+	}
+	releaseRange := func(rr reservationRange) {
+		sr := newSlotReservation()
+		sr.release(rr.startAt, rr.endAt)
+		unhold(rr)
+		sr.Commit()
+	}
+	randomRange := func(r *rand.Rand) reservationRange {
+		start := r.Intn(numSlots)
+		end := start + 1 + r.Intn(numSlots-start)
+		return reservationRange{startAt: int64(start * step), endAt: int64(end * step)}
+	}
+
+	done := make(chan struct{})
+	var monitor sync.WaitGroup
+	monitor.Add(1)
+	go func() {
+		defer monitor.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			runtime.Gosched()
+			for _, s := range slots {
+				if remaining := s.remaining.Load(); remaining < 0 {
+					t.Errorf("slot %d has negative remaining %d", slotNumber(s), remaining)
+					return
+				}
+			}
+		}
+	}()
+
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	for g := 0; g < goroutines; g++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			r := rand.New(rand.NewSource(seed))
+			<-start
+			// 確保した区間を複数保持し、他の goroutine と枠を取り合う
+			var mine []reservationRange
+			for i := 0; i < iterations; i++ {
+				// CPU が少なくても goroutine 同士の操作が入り混じるようにする
+				runtime.Gosched()
+
+				switch op := r.Intn(3); {
+				case op == 0 || len(mine) == 0:
+					rr := randomRange(r)
+					sr := newSlotReservation()
+					if !sr.acquire(rr.startAt, rr.endAt) {
+						sr.Rollback()
+						continue
+					}
+					runtime.Gosched()
+					// 確保してもコミットしなければ戻る
+					if r.Intn(4) == 0 {
+						sr.Rollback()
+						continue
+					}
+					hold(rr)
+					sr.Commit()
+					// 呼び出し側の defer と同じく、Commit 後の Rollback は何もしない
+					sr.Rollback()
+					mine = append(mine, rr)
+				case op == 1:
+					// 別の区間に付け替える
+					k := r.Intn(len(mine))
+					rr, next := mine[k], randomRange(r)
+					sr := newSlotReservation()
+					if !sr.reschedule(rr.startAt, rr.endAt, next.startAt, next.endAt) {
+						sr.Rollback()
+						continue
+					}
+					runtime.Gosched()
+					if r.Intn(4) == 0 {
+						sr.Rollback()
+						continue
+					}
+					// 付け替え先の確保は反映済み、付け替え元の返却は Commit で反映される
+					unhold(rr)
+					hold(next)
+					sr.Commit()
+					mine[k] = next
+				default:
+					k := r.Intn(len(mine))
+					releaseRange(mine[k])
+					mine = append(mine[:k], mine[k+1:]...)
+				}
+			}
+			for _, rr := range mine {
+				releaseRange(rr)
+			}
+		}(int64(g))
+	}
+	close(start)
+	wg.Wait()
+	close(done)
+	monitor.Wait()
+
+	for _, s := range slots {
+		if remaining := s.remaining.Load(); remaining != capacity {
+			t.Errorf("slot %d has remaining %d after all reservations were released, want %d", slotNumber(s), remaining, capacity)
+		}
+	}
+}
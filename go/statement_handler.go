@@ -0,0 +1,295 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+// 投げ銭に対するプラットフォーム手数料 (%)
+var platformFeePercent int64 = 10
+
+type PayoutStatement struct {
+	Username    string `json:"username"`
+	Month       string `json:"month"`
+	FeePercent  int64  `json:"fee_percent"`
+	GrossTip    int64  `json:"gross_tip"`
+	PlatformFee int64  `json:"platform_fee"`
+	Refunds     int64  `json:"refunds"`
+	// 前月までに返金が売上を上回って持ち越した残高 (0 以下)
+	CarriedOver int64 `json:"carried_over"`
+	NetPayout   int64 `json:"net_payout"`
+	// 当月の残高がマイナスになり翌月に持ち越す額 (0 以下)
+	CarryForward int64                       `json:"carry_forward"`
+	Livestreams  []PayoutStatementLivestream `json:"livestreams"`
+}
+
+type PayoutStatementLivestream struct {
+	LivestreamID int64  `json:"livestream_id" db:"livestream_id"`
+	Title        string `json:"title" db:"title"`
+	TipCount     int64  `json:"tip_count" db:"tip_count"`
+	GrossTip     int64  `json:"gross_tip" db:"gross_tip"`
+	PlatformFee  int64  `json:"platform_fee" db:"-"`
+	Refunds      int64  `json:"refunds" db:"refunds"`
+	NetPayout    int64  `json:"net_payout" db:"-"`
+}
+
+// 配信者向け月次精算書API
+// GET /api/user/:username/statement?month=2024-01&format=json|csv|pdf
+func getPayoutStatementHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	username := c.Param("username")
+
+	month, err := time.ParseInLocation("2006-01", c.QueryParam("month"), time.UTC)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "month query parameter must be formatted as YYYY-MM")
+	}
+	monthStartAt := month.Unix()
+	monthEndAt := month.AddDate(0, 1, 0).Unix()
+
+	format := c.QueryParam("format")
+	if format == "" {
+		format = "json"
+	}
+	if format != "json" && format != "csv" && format != "pdf" {
+		return echo.NewHTTPError(http.StatusBadRequest, "format query parameter must be one of json, csv, pdf")
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	var user UserModel
+	if err := tx.GetContext(ctx, &user, "SELECT * FROM users WHERE name = ?", username); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "not found user that has the given username")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user: "+err.Error())
+	}
+
+	if user.ID != userID {
+		return echo.NewHTTPError(http.StatusForbidden, "can't get other streamer's statement")
+	}
+
+	// 配信ごとにチップと返金を集計
+	var livestreams []PayoutStatementLivestream
+	query := `
+		SELECT
+			l.id AS livestream_id,
+			l.title AS title,
+			COUNT(CASE WHEN t.kind = 'tip' THEN 1 END) AS tip_count,
+			IFNULL(SUM(CASE WHEN t.kind = 'tip' THEN t.amount ELSE 0 END), 0) AS gross_tip,
+			IFNULL(SUM(CASE WHEN t.kind = 'refund' THEN -t.amount ELSE 0 END), 0) AS refunds
+		FROM tip_ledger t
+		INNER JOIN livestreams l ON l.id = t.livestream_id
+		WHERE l.user_id = ? AND t.created_at >= ? AND t.created_at < ?
+		GROUP BY l.id, l.title
+		ORDER BY l.id
+	`
+	if err := tx.SelectContext(ctx, &livestreams, query, user.ID, monthStartAt, monthEndAt); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get tips: "+err.Error())
+	}
+
+	carriedOver, err := getPayoutCarriedOver(ctx, tx, user.ID, monthStartAt)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get carried over balance: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	statement := PayoutStatement{
+		Username:    user.Name,
+		Month:       month.Format("2006-01"),
+		FeePercent:  platformFeePercent,
+		Livestreams: make([]PayoutStatementLivestream, len(livestreams)),
+	}
+	var balance int64
+	for i, ls := range livestreams {
+		ls.PlatformFee, ls.NetPayout = payoutOf(ls.GrossTip, ls.Refunds)
+		statement.Livestreams[i] = ls
+		statement.GrossTip += ls.GrossTip
+		statement.PlatformFee += ls.PlatformFee
+		statement.Refunds += ls.Refunds
+		balance += ls.NetPayout
+	}
+	// 残高がマイナスの場合は支払わずに翌月へ持ち越す
+	statement.CarriedOver = carriedOver
+	balance += carriedOver
+	statement.NetPayout = max(balance, 0)
+	statement.CarryForward = min(balance, 0)
+
+	filename := fmt.Sprintf("statement-%s-%s", statement.Username, statement.Month)
+	switch format {
+	case "csv":
+		body, err := renderPayoutStatementCSV(statement)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to render csv: "+err.Error())
+		}
+		c.Response().Header().Set(echo.HeaderContentDisposition, fmt.Sprintf(`attachment; filename="%s.csv"`, filename))
+		return c.Blob(http.StatusOK, "text/csv; charset=utf-8", body)
+	case "pdf":
+		c.Response().Header().Set(echo.HeaderContentDisposition, fmt.Sprintf(`attachment; filename="%s.pdf"`, filename))
+		return c.Blob(http.StatusOK, "application/pdf", renderPayoutStatementPDF(statement))
+	default:
+		return c.JSON(http.StatusOK, statement)
+	}
+}
+
+// payoutOf は配信ごとの手数料と支払額を求める
+// 手数料は返金差し引き後の金額から切り捨てで算出する。返金が上回った場合は手数料を取らず、支払額はマイナスになる
+func payoutOf(grossTip, refunds int64) (platformFee, netPayout int64) {
+	platformFee = max(grossTip-refunds, 0) * platformFeePercent / 100
+	return platformFee, grossTip - refunds - platformFee
+}
+
+// getPayoutCarriedOver は before より前の月から持ち越したマイナスの残高を求める
+// 月ごとに精算書と同じ計算をし、残高がマイナスの月はその額を翌月に持ち越す
+func getPayoutCarriedOver(ctx context.Context, tx *sqlx.Tx, userID int64, before int64) (int64, error) {
+	// 月の境界は UTC の日の境界と一致するので、日ごとに集計してから月にまとめる
+	var rows []struct {
+		LivestreamID int64 `db:"livestream_id"`
+		Day          int64 `db:"day"`
+		GrossTip     int64 `db:"gross_tip"`
+		Refunds      int64 `db:"refunds"`
+	}
+	query := `
+		SELECT
+			t.livestream_id AS livestream_id,
+			t.created_at DIV 86400 AS day,
+			IFNULL(SUM(CASE WHEN t.kind = 'tip' THEN t.amount ELSE 0 END), 0) AS gross_tip,
+			IFNULL(SUM(CASE WHEN t.kind = 'refund' THEN -t.amount ELSE 0 END), 0) AS refunds
+		FROM tip_ledger t
+		INNER JOIN livestreams l ON l.id = t.livestream_id
+		WHERE l.user_id = ? AND t.created_at < ?
+		GROUP BY t.livestream_id, day
+	`
+	if err := tx.SelectContext(ctx, &rows, query, userID, before); err != nil {
+		return 0, err
+	}
+
+	type monthLivestream struct {
+		month        string
+		livestreamID int64
+	}
+	totals := make(map[monthLivestream][2]int64)
+	months := make(map[string]struct{})
+	for _, r := range rows {
+		key := monthLivestream{
+			month:        time.Unix(r.Day*86400, 0).UTC().Format("2006-01"),
+			livestreamID: r.LivestreamID,
+		}
+		t := totals[key]
+		totals[key] = [2]int64{t[0] + r.GrossTip, t[1] + r.Refunds}
+		months[key.month] = struct{}{}
+	}
+	monthNet := make(map[string]int64, len(months))
+	for key, t := range totals {
+		_, net := payoutOf(t[0], t[1])
+		monthNet[key.month] += net
+	}
+	sortedMonths := make([]string, 0, len(months))
+	for m := range months {
+		sortedMonths = append(sortedMonths, m)
+	}
+	sort.Strings(sortedMonths)
+
+	var carried int64
+	for _, m := range sortedMonths {
+		carried = min(carried+monthNet[m], 0)
+	}
+	return carried, nil
+}
+
+func renderPayoutStatementCSV(statement PayoutStatement) ([]byte, error) {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	records := [][]string{
+		{"livestream_id", "title", "tip_count", "gross_tip", "platform_fee", "refunds", "net_payout"},
+	}
+	// total は各ライブ配信の net_payout の合計とし、前月からの持ち越しを反映した支払額は最後の行に出す
+	// total + carried_over = net_payout + carry_forward になる
+	var total int64
+	for _, ls := range statement.Livestreams {
+		total += ls.NetPayout
+		records = append(records, []string{
+			strconv.FormatInt(ls.LivestreamID, 10),
+			ls.Title,
+			strconv.FormatInt(ls.TipCount, 10),
+			strconv.FormatInt(ls.GrossTip, 10),
+			strconv.FormatInt(ls.PlatformFee, 10),
+			strconv.FormatInt(ls.Refunds, 10),
+			strconv.FormatInt(ls.NetPayout, 10),
+		})
+	}
+	records = append(records, []string{
+		"total",
+		"",
+		"",
+		strconv.FormatInt(statement.GrossTip, 10),
+		strconv.FormatInt(statement.PlatformFee, 10),
+		strconv.FormatInt(statement.Refunds, 10),
+		strconv.FormatInt(total, 10),
+	})
+	records = append(records,
+		[]string{"carried_over", "", "", "", "", "", strconv.FormatInt(statement.CarriedOver, 10)},
+		[]string{"carry_forward", "", "", "", "", "", strconv.FormatInt(statement.CarryForward, 10)},
+		[]string{"net_payout", "", "", "", "", "", strconv.FormatInt(statement.NetPayout, 10)},
+	)
+	if err := w.WriteAll(records); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func renderPayoutStatementPDF(statement PayoutStatement) []byte {
+	lines := []string{
+		"ISUPipe Payout Statement",
+		"",
+		fmt.Sprintf("Streamer:     %s", statement.Username),
+		fmt.Sprintf("Month:        %s", statement.Month),
+		"",
+		fmt.Sprintf("Gross tips:   %d", statement.GrossTip),
+		fmt.Sprintf("Platform fee: %d (%d%%)", statement.PlatformFee, statement.FeePercent),
+		fmt.Sprintf("Refunds:      %d", statement.Refunds),
+		fmt.Sprintf("Carried over: %d", statement.CarriedOver),
+		fmt.Sprintf("Net payout:   %d", statement.NetPayout),
+		fmt.Sprintf("Carry fwd:    %d", statement.CarryForward),
+		"",
+		"Livestreams",
+	}
+	for _, ls := range statement.Livestreams {
+		// PDF に出せない文字を含むタイトルは省略し、配信IDで示す
+		if isPDFText(ls.Title) {
+			lines = append(lines, fmt.Sprintf("#%d %s", ls.LivestreamID, ls.Title))
+		} else {
+			lines = append(lines, fmt.Sprintf("#%d (title omitted: see the CSV or JSON statement)", ls.LivestreamID))
+		}
+		lines = append(lines, fmt.Sprintf("    tips: %d  gross: %d  fee: %d  refunds: %d  net: %d", ls.TipCount, ls.GrossTip, ls.PlatformFee, ls.Refunds, ls.NetPayout))
+	}
+	return renderTextPDF(lines)
+}
@@ -6,6 +6,7 @@ import (
 	"net/http"
 	"sort"
 	"strconv"
+	"time"
 
 	"github.com/labstack/echo/v4"
 )
@@ -16,6 +17,11 @@ type LivestreamStatistics struct {
 	TotalReactions int64 `json:"total_reactions"`
 	TotalReports   int64 `json:"total_reports"`
 	MaxTip         int64 `json:"max_tip"`
+	// ハートビートが続いている同時視聴者数と、その最大値
+	ConcurrentViewers     int64 `json:"concurrent_viewers"`
+	PeakConcurrentViewers int64 `json:"peak_concurrent_viewers"`
+	// 一度でも入室したユーザの数
+	UniqueViewers int64 `json:"unique_viewers"`
 }
 
 type LivestreamRankingEntry struct {
@@ -93,7 +99,7 @@ func getUserStatisticsHandler(c echo.Context) error {
 		}
 	}
 
-	// ランク算出: 全ユーザーのスコア（リアクション数 + チップ合計）を一括取得
+	// ランク算出: 全ユーザーのスコア（リアクション数 + 返金を差し引いたチップ合計）を一括取得
 	var userScores []UserScoreEntry
 	rankQuery := `
 		SELECT
@@ -108,8 +114,8 @@ func getUserStatisticsHandler(c echo.Context) error {
 			GROUP BY livestream_id
 		) r ON r.livestream_id = l.id
 		LEFT JOIN (
-			SELECT livestream_id, SUM(tip) AS tip_sum
-			FROM livecomments
+			SELECT livestream_id, SUM(amount) AS tip_sum
+			FROM tip_ledger
 			GROUP BY livestream_id
 		) lc ON lc.livestream_id = l.id
 		GROUP BY u.id, u.name
@@ -148,7 +154,7 @@ func getUserStatisticsHandler(c echo.Context) error {
 		SELECT
 			IFNULL(SUM(r.reaction_count), 0) AS total_reactions,
 			IFNULL(SUM(lc.livecomment_count), 0) AS total_livecomments,
-			IFNULL(SUM(lc.tip_sum), 0) AS total_tip,
+			IFNULL(SUM(t.tip_sum), 0) AS total_tip,
 			IFNULL(SUM(v.viewers_count), 0) AS viewers_count
 		FROM livestreams l
 		LEFT JOIN (
@@ -157,13 +163,19 @@ func getUserStatisticsHandler(c echo.Context) error {
 			GROUP BY livestream_id
 		) r ON r.livestream_id = l.id
 		LEFT JOIN (
-			SELECT livestream_id, COUNT(*) AS livecomment_count, SUM(tip) AS tip_sum
+			SELECT livestream_id, COUNT(*) AS livecomment_count
 			FROM livecomments
 			GROUP BY livestream_id
 		) lc ON lc.livestream_id = l.id
+		LEFT JOIN (
+			SELECT livestream_id, SUM(amount) AS tip_sum
+			FROM tip_ledger
+			GROUP BY livestream_id
+		) t ON t.livestream_id = l.id
 		LEFT JOIN (
 			SELECT livestream_id, COUNT(*) AS viewers_count
 			FROM livestream_viewers_history
+			WHERE exited_at = 0
 			GROUP BY livestream_id
 		) v ON v.livestream_id = l.id
 		WHERE l.user_id = ?
@@ -233,7 +245,7 @@ func getLivestreamStatisticsHandler(c echo.Context) error {
 		}
 	}
 
-	// ランク算出: 全ライブストリームのスコア（リアクション数 + チップ合計）を一括取得
+	// ランク算出: 全ライブストリームのスコア（リアクション数 + 返金を差し引いたチップ合計）を一括取得
 	var livestreamScores []LivestreamScoreEntry
 	rankQuery := `
 		SELECT
@@ -246,8 +258,8 @@ func getLivestreamStatisticsHandler(c echo.Context) error {
 			GROUP BY livestream_id
 		) r ON r.livestream_id = l.id
 		LEFT JOIN (
-			SELECT livestream_id, SUM(tip) AS tip_sum
-			FROM livecomments
+			SELECT livestream_id, SUM(amount) AS tip_sum
+			FROM tip_ledger
 			GROUP BY livestream_id
 		) lc ON lc.livestream_id = l.id
 	`
@@ -275,15 +287,18 @@ func getLivestreamStatisticsHandler(c echo.Context) error {
 	}
 
 	// 対象ライブストリームの統計を一括取得
+	// 最大チップは台帳からライブコメントごとに返金を差し引いた額で求める
 	var livestreamStats struct {
 		ViewersCount   int64 `db:"viewers_count"`
 		MaxTip         int64 `db:"max_tip"`
 		TotalReactions int64 `db:"total_reactions"`
 		TotalReports   int64 `db:"total_reports"`
+		UniqueViewers  int64 `db:"unique_viewers"`
 	}
 	statsQuery := `
 		SELECT
 			IFNULL(v.viewers_count, 0) AS viewers_count,
+			IFNULL(uv.unique_viewers, 0) AS unique_viewers,
 			IFNULL(lc.max_tip, 0) AS max_tip,
 			IFNULL(r.reaction_count, 0) AS total_reactions,
 			IFNULL(rep.report_count, 0) AS total_reports
@@ -291,11 +306,22 @@ func getLivestreamStatisticsHandler(c echo.Context) error {
 		LEFT JOIN (
 			SELECT livestream_id, COUNT(*) AS viewers_count
 			FROM livestream_viewers_history
+			WHERE exited_at = 0
 			GROUP BY livestream_id
 		) v ON v.livestream_id = l.id
 		LEFT JOIN (
-			SELECT livestream_id, MAX(tip) AS max_tip
-			FROM livecomments
+			SELECT livestream_id, COUNT(DISTINCT user_id) AS unique_viewers
+			FROM livestream_viewers_history
+			GROUP BY livestream_id
+		) uv ON uv.livestream_id = l.id
+		LEFT JOIN (
+			SELECT livestream_id, MAX(net_tip) AS max_tip
+			FROM (
+				SELECT livestream_id, SUM(amount) AS net_tip
+				FROM tip_ledger
+				GROUP BY livestream_id, livecomment_id
+			) t
+			WHERE net_tip > 0
 			GROUP BY livestream_id
 		) lc ON lc.livestream_id = l.id
 		LEFT JOIN (
@@ -318,11 +344,16 @@ func getLivestreamStatisticsHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
 	}
 
+	concurrent := presence.concurrent([]int64{livestreamID}, time.Now())[livestreamID]
+
 	return c.JSON(http.StatusOK, LivestreamStatistics{
-		Rank:           rank,
-		ViewersCount:   livestreamStats.ViewersCount,
-		MaxTip:         livestreamStats.MaxTip,
-		TotalReactions: livestreamStats.TotalReactions,
-		TotalReports:   livestreamStats.TotalReports,
+		Rank:                  rank,
+		ViewersCount:          livestreamStats.ViewersCount,
+		MaxTip:                livestreamStats.MaxTip,
+		TotalReactions:        livestreamStats.TotalReactions,
+		TotalReports:          livestreamStats.TotalReports,
+		ConcurrentViewers:     concurrent,
+		PeakConcurrentViewers: livestream.PeakViewers,
+		UniqueViewers:         livestreamStats.UniqueViewers,
 	})
 }
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	defaultSupportersLimit = 10
+	maxSupportersLimit     = 100
+)
+
+type Supporter struct {
+	Rank         int64 `json:"rank"`
+	User         User  `json:"user"`
+	TotalTip     int64 `json:"total_tip"`
+	CommentCount int64 `json:"comment_count"`
+}
+
+// SupporterScoreEntry はユーザーごとのチップ合計とコメント数の集計用
+type SupporterScoreEntry struct {
+	UserID       int64  `db:"user_id"`
+	Username     string `db:"username"`
+	TotalTip     int64  `db:"total_tip"`
+	CommentCount int64  `db:"comment_count"`
+}
+
+// 配信ごとのトップサポーター
+// GET /api/livestream/:livestream_id/supporters?limit=10
+func getLivestreamSupportersHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	limit, err := parseSupportersLimit(c)
+	if err != nil {
+		return err
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	var livestreamModel LivestreamModel
+	if err := tx.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ?", livestreamID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "livestream not found")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+	}
+
+	var entries []SupporterScoreEntry
+	query := `
+		SELECT
+			u.id AS user_id,
+			u.name AS username,
+			t.total_tip AS total_tip,
+			IFNULL(lc.comment_count, 0) AS comment_count
+		FROM (
+			SELECT user_id, SUM(amount) AS total_tip
+			FROM tip_ledger
+			WHERE livestream_id = ?
+			GROUP BY user_id
+		) t
+		INNER JOIN users u ON u.id = t.user_id
+		LEFT JOIN (
+			SELECT user_id, COUNT(*) AS comment_count
+			FROM livecomments
+			WHERE livestream_id = ?
+			GROUP BY user_id
+		) lc ON lc.user_id = t.user_id
+		WHERE t.total_tip > 0
+	`
+	if err := tx.SelectContext(ctx, &entries, query, livestreamModel.ID, livestreamModel.ID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get supporters: "+err.Error())
+	}
+
+	supporters, err := rankSupporters(ctx, tx, entries, limit)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill supporters: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, supporters)
+}
+
+// 配信者の全配信を通したトップサポーター
+// GET /api/user/:username/supporters?period=day|week|month|all&limit=10
+func getUserSupportersHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	username := c.Param("username")
+
+	limit, err := parseSupportersLimit(c)
+	if err != nil {
+		return err
+	}
+
+	// 集計期間の開始時刻 (0 は全期間)
+	var since int64
+	now := time.Now()
+	switch c.QueryParam("period") {
+	case "", "all":
+	case "day":
+		since = now.AddDate(0, 0, -1).Unix()
+	case "week":
+		since = now.AddDate(0, 0, -7).Unix()
+	case "month":
+		since = now.AddDate(0, -1, 0).Unix()
+	default:
+		return echo.NewHTTPError(http.StatusBadRequest, "period query parameter must be one of day, week, month, all")
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	var user UserModel
+	if err := tx.GetContext(ctx, &user, "SELECT * FROM users WHERE name = ?", username); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "not found user that has the given username")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user: "+err.Error())
+	}
+
+	var entries []SupporterScoreEntry
+	query := `
+		SELECT
+			u.id AS user_id,
+			u.name AS username,
+			t.total_tip AS total_tip,
+			IFNULL(lc.comment_count, 0) AS comment_count
+		FROM (
+			SELECT tl.user_id, SUM(tl.amount) AS total_tip
+			FROM tip_ledger tl
+			INNER JOIN livestreams l ON l.id = tl.livestream_id
+			WHERE l.user_id = ? AND tl.created_at >= ?
+			GROUP BY tl.user_id
+		) t
+		INNER JOIN users u ON u.id = t.user_id
+		LEFT JOIN (
+			SELECT c.user_id, COUNT(*) AS comment_count
+			FROM livecomments c
+			INNER JOIN livestreams l ON l.id = c.livestream_id
+			WHERE l.user_id = ? AND c.created_at >= ?
+			GROUP BY c.user_id
+		) lc ON lc.user_id = t.user_id
+		WHERE t.total_tip > 0
+	`
+	if err := tx.SelectContext(ctx, &entries, query, user.ID, since, user.ID, since); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get supporters: "+err.Error())
+	}
+
+	supporters, err := rankSupporters(ctx, tx, entries, limit)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill supporters: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, supporters)
+}
+
+func parseSupportersLimit(c echo.Context) (int, error) {
+	if c.QueryParam("limit") == "" {
+		return defaultSupportersLimit, nil
+	}
+	limit, err := strconv.Atoi(c.QueryParam("limit"))
+	if err != nil || limit < 1 || limit > maxSupportersLimit {
+		return 0, echo.NewHTTPError(http.StatusBadRequest, "limit query parameter must be between 1 and "+strconv.Itoa(maxSupportersLimit))
+	}
+	return limit, nil
+}
+
+// rankSupporters はチップ合計で順位付けし、上位 limit 件の Supporter を構築する
+// 同点の場合の並びはユーザーランキング (UserRanking) と同じ規則に従う
+func rankSupporters(ctx context.Context, tx *sqlx.Tx, entries []SupporterScoreEntry, limit int) ([]Supporter, error) {
+	if len(entries) == 0 {
+		return []Supporter{}, nil
+	}
+
+	entryMap := make(map[string]SupporterScoreEntry, len(entries))
+	ranking := make(UserRanking, 0, len(entries))
+	for _, e := range entries {
+		entryMap[e.Username] = e
+		ranking = append(ranking, UserRankingEntry{
+			Username: e.Username,
+			Score:    e.TotalTip,
+		})
+	}
+	sort.Sort(ranking)
+
+	// ランキングは昇順なので末尾から取り出す
+	top := make([]SupporterScoreEntry, 0, limit)
+	for i := len(ranking) - 1; i >= 0 && len(top) < limit; i-- {
+		top = append(top, entryMap[ranking[i].Username])
+	}
+
+	userIDs := make([]int64, len(top))
+	for i, e := range top {
+		userIDs[i] = e.UserID
+	}
+	query, args, err := sqlx.In("SELECT * FROM users WHERE id IN (?)", userIDs)
+	if err != nil {
+		return nil, err
+	}
+	var userModels []UserModel
+	if err := tx.SelectContext(ctx, &userModels, query, args...); err != nil {
+		return nil, err
+	}
+	users, err := fillUsersResponse(ctx, tx, userModels)
+	if err != nil {
+		return nil, err
+	}
+	userMap := make(map[int64]User, len(users))
+	for i, u := range userModels {
+		userMap[u.ID] = users[i]
+	}
+
+	supporters := make([]Supporter, len(top))
+	for i, e := range top {
+		supporters[i] = Supporter{
+			Rank:         int64(i + 1),
+			User:         userMap[e.UserID],
+			TotalTip:     e.TotalTip,
+			CommentCount: e.CommentCount,
+		}
+	}
+	return supporters, nil
+}
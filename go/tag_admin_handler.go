@@ -0,0 +1,435 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+type TagAliasModel struct {
+	ID    int64  `db:"id"`
+	TagID int64  `db:"tag_id"`
+	Name  string `db:"name"`
+}
+
+type TagAlias struct {
+	ID   int64  `json:"id"`
+	Name string `json:"name"`
+}
+
+// AdminTag は別名を含むタグ
+type AdminTag struct {
+	ID      int64      `json:"id"`
+	Name    string     `json:"name"`
+	Aliases []TagAlias `json:"aliases"`
+}
+
+type PostTagRequest struct {
+	Name string `json:"name"`
+}
+
+type MergeTagRequest struct {
+	// 統合先のタグ
+	Into int64 `json:"into"`
+}
+
+// resolveTagNames はタグ名または別名を正規のタグIDに解決する。解決できない名前は含まれない
+func resolveTagNames(ctx context.Context, q sqlx.QueryerContext, names []string) (map[string]int64, error) {
+	resolved := make(map[string]int64, len(names))
+	if len(names) == 0 {
+		return resolved, nil
+	}
+	query, args, err := sqlx.In("SELECT name, id FROM tags WHERE name IN (?) UNION ALL SELECT name, tag_id AS id FROM tag_aliases WHERE name IN (?)", names, names)
+	if err != nil {
+		return nil, err
+	}
+	var rows []struct {
+		Name string `db:"name"`
+		ID   int64  `db:"id"`
+	}
+	if err := sqlx.SelectContext(ctx, q, &rows, query, args...); err != nil {
+		return nil, err
+	}
+	for _, r := range rows {
+		resolved[r.Name] = r.ID
+	}
+	return resolved, nil
+}
+
+// verifyTagNameAvailable はタグ名と別名の両方で名前が使われていないかを検査する
+func verifyTagNameAvailable(ctx context.Context, tx *sqlx.Tx, name string) error {
+	var count int64
+	if err := tx.GetContext(ctx, &count, "SELECT (SELECT COUNT(*) FROM tags WHERE name = ?) + (SELECT COUNT(*) FROM tag_aliases WHERE name = ?)", name, name); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get tags: "+err.Error())
+	}
+	if count > 0 {
+		return echo.NewHTTPError(http.StatusConflict, "tag name is already used: "+name)
+	}
+	return nil
+}
+
+func decodeTagName(c echo.Context) (string, error) {
+	var req PostTagRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return "", echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+	name := strings.TrimSpace(req.Name)
+	if name == "" {
+		return "", echo.NewHTTPError(http.StatusBadRequest, "name must not be empty")
+	}
+	return name, nil
+}
+
+func getTagForUpdate(ctx context.Context, tx *sqlx.Tx, tagID int64) (TagModel, error) {
+	var tagModel TagModel
+	if err := tx.GetContext(ctx, &tagModel, "SELECT * FROM tags WHERE id = ? FOR UPDATE", tagID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return TagModel{}, echo.NewHTTPError(http.StatusNotFound, "tag not found")
+		}
+		return TagModel{}, echo.NewHTTPError(http.StatusInternalServerError, "failed to get tag: "+err.Error())
+	}
+	return tagModel, nil
+}
+
+func fillAdminTagResponse(ctx context.Context, tx *sqlx.Tx, tagModel TagModel) (AdminTag, error) {
+	var aliasModels []TagAliasModel
+	if err := tx.SelectContext(ctx, &aliasModels, "SELECT * FROM tag_aliases WHERE tag_id = ? ORDER BY id", tagModel.ID); err != nil {
+		return AdminTag{}, err
+	}
+	aliases := make([]TagAlias, len(aliasModels))
+	for i, a := range aliasModels {
+		aliases[i] = TagAlias{ID: a.ID, Name: a.Name}
+	}
+	return AdminTag{
+		ID:      tagModel.ID,
+		Name:    tagModel.Name,
+		Aliases: aliases,
+	}, nil
+}
+
+// タグ一覧 (別名付き)
+// GET /api/admin/tag
+func getAdminTagsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyAdminSession(c); err != nil {
+		return err
+	}
+
+	var tagModels []TagModel
+	if err := dbConn.SelectContext(ctx, &tagModels, "SELECT * FROM tags ORDER BY id"); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get tags: "+err.Error())
+	}
+	var aliasModels []TagAliasModel
+	if err := dbConn.SelectContext(ctx, &aliasModels, "SELECT * FROM tag_aliases ORDER BY id"); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get tag aliases: "+err.Error())
+	}
+	aliasMap := make(map[int64][]TagAlias)
+	for _, a := range aliasModels {
+		aliasMap[a.TagID] = append(aliasMap[a.TagID], TagAlias{ID: a.ID, Name: a.Name})
+	}
+
+	tags := make([]AdminTag, len(tagModels))
+	for i, t := range tagModels {
+		aliases := aliasMap[t.ID]
+		if aliases == nil {
+			aliases = []TagAlias{}
+		}
+		tags[i] = AdminTag{
+			ID:      t.ID,
+			Name:    t.Name,
+			Aliases: aliases,
+		}
+	}
+
+	return c.JSON(http.StatusOK, tags)
+}
+
+// タグの作成
+// POST /api/admin/tag
+func postTagHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	if err := verifyAdminSession(c); err != nil {
+		return err
+	}
+
+	name, err := decodeTagName(c)
+	if err != nil {
+		return err
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	if err := verifyTagNameAvailable(ctx, tx, name); err != nil {
+		return err
+	}
+	rs, err := tx.ExecContext(ctx, "INSERT INTO tags (name) VALUES (?)", name)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert tag: "+err.Error())
+	}
+	tagID, err := rs.LastInsertId()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get last inserted tag id: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.JSON(http.StatusCreated, AdminTag{
+		ID:      tagID,
+		Name:    name,
+		Aliases: []TagAlias{},
+	})
+}
+
+// タグの名前の変更
+// PATCH /api/admin/tag/:tag_id
+func renameTagHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	if err := verifyAdminSession(c); err != nil {
+		return err
+	}
+
+	tagID, err := strconv.Atoi(c.Param("tag_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "tag_id in path must be integer")
+	}
+	name, err := decodeTagName(c)
+	if err != nil {
+		return err
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	tagModel, err := getTagForUpdate(ctx, tx, int64(tagID))
+	if err != nil {
+		return err
+	}
+	if tagModel.Name != name {
+		if err := verifyTagNameAvailable(ctx, tx, name); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, "UPDATE tags SET name = ? WHERE id = ?", name, tagModel.ID); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to update tag: "+err.Error())
+		}
+		tagModel.Name = name
+	}
+
+	tag, err := fillAdminTagResponse(ctx, tx, tagModel)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill tag: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, tag)
+}
+
+// タグの削除 (ライブ配信に付与されたタグと別名も削除する)
+// DELETE /api/admin/tag/:tag_id
+func deleteTagHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyAdminSession(c); err != nil {
+		return err
+	}
+
+	tagID, err := strconv.Atoi(c.Param("tag_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "tag_id in path must be integer")
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	tagModel, err := getTagForUpdate(ctx, tx, int64(tagID))
+	if err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM livestream_tags WHERE tag_id = ?", tagModel.ID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete livestream tags: "+err.Error())
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM tag_aliases WHERE tag_id = ?", tagModel.ID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete tag aliases: "+err.Error())
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM tags WHERE id = ?", tagModel.ID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete tag: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// タグの統合
+// 統合元のタグが付いたライブ配信を統合先のタグに付け替え、統合元の名前と別名は統合先の別名にする
+// POST /api/admin/tag/:tag_id/merge
+func mergeTagHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	if err := verifyAdminSession(c); err != nil {
+		return err
+	}
+
+	tagID, err := strconv.Atoi(c.Param("tag_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "tag_id in path must be integer")
+	}
+	var req MergeTagRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+	if req.Into == int64(tagID) {
+		return echo.NewHTTPError(http.StatusBadRequest, "can't merge a tag into itself")
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	source, err := getTagForUpdate(ctx, tx, int64(tagID))
+	if err != nil {
+		return err
+	}
+	target, err := getTagForUpdate(ctx, tx, req.Into)
+	if err != nil {
+		return err
+	}
+
+	// 既に統合先のタグが付いている配信では重複しないよう統合元を消し、残りを付け替える
+	if _, err := tx.ExecContext(ctx, "DELETE s FROM livestream_tags s INNER JOIN livestream_tags t ON t.livestream_id = s.livestream_id AND t.tag_id = ? WHERE s.tag_id = ?", target.ID, source.ID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete livestream tags: "+err.Error())
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE livestream_tags SET tag_id = ? WHERE tag_id = ?", target.ID, source.ID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to update livestream tags: "+err.Error())
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE tag_aliases SET tag_id = ? WHERE tag_id = ?", target.ID, source.ID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to update tag aliases: "+err.Error())
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM tags WHERE id = ?", source.ID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete tag: "+err.Error())
+	}
+	if _, err := tx.ExecContext(ctx, "INSERT INTO tag_aliases (tag_id, name) VALUES (?, ?)", target.ID, source.Name); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert tag alias: "+err.Error())
+	}
+
+	tag, err := fillAdminTagResponse(ctx, tx, target)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill tag: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, tag)
+}
+
+// タグの別名の追加
+// POST /api/admin/tag/:tag_id/alias
+func postTagAliasHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	if err := verifyAdminSession(c); err != nil {
+		return err
+	}
+
+	tagID, err := strconv.Atoi(c.Param("tag_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "tag_id in path must be integer")
+	}
+	name, err := decodeTagName(c)
+	if err != nil {
+		return err
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	tagModel, err := getTagForUpdate(ctx, tx, int64(tagID))
+	if err != nil {
+		return err
+	}
+	if err := verifyTagNameAvailable(ctx, tx, name); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "INSERT INTO tag_aliases (tag_id, name) VALUES (?, ?)", tagModel.ID, name); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert tag alias: "+err.Error())
+	}
+
+	tag, err := fillAdminTagResponse(ctx, tx, tagModel)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill tag: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.JSON(http.StatusCreated, tag)
+}
+
+// タグの別名の削除
+// DELETE /api/admin/tag/:tag_id/alias/:alias_id
+func deleteTagAliasHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyAdminSession(c); err != nil {
+		return err
+	}
+
+	tagID, err := strconv.Atoi(c.Param("tag_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "tag_id in path must be integer")
+	}
+	aliasID, err := strconv.Atoi(c.Param("alias_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "alias_id in path must be integer")
+	}
+
+	rs, err := dbConn.ExecContext(ctx, "DELETE FROM tag_aliases WHERE id = ? AND tag_id = ?", aliasID, tagID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete tag alias: "+err.Error())
+	}
+	if n, err := rs.RowsAffected(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get affected rows: "+err.Error())
+	} else if n == 0 {
+		return echo.NewHTTPError(http.StatusNotFound, "tag alias not found")
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
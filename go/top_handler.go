@@ -1,10 +1,13 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"errors"
+	"fmt"
 	"net/http"
 
+	"github.com/jmoiron/sqlx"
 	"github.com/labstack/echo/v4"
 )
 
@@ -52,6 +55,44 @@ func getTagHandler(c echo.Context) error {
 	})
 }
 
+// missingTagIDs は tags に存在しないタグIDを返す
+func missingTagIDs(ctx context.Context, q sqlx.QueryerContext, tagIDs []int64) ([]int64, error) {
+	if len(tagIDs) == 0 {
+		return nil, nil
+	}
+	query, args, err := sqlx.In("SELECT id FROM tags WHERE id IN (?)", tagIDs)
+	if err != nil {
+		return nil, err
+	}
+	var found []int64
+	if err := sqlx.SelectContext(ctx, q, &found, query, args...); err != nil {
+		return nil, err
+	}
+	exists := make(map[int64]struct{}, len(found))
+	for _, id := range found {
+		exists[id] = struct{}{}
+	}
+	var missing []int64
+	for _, id := range tagIDs {
+		if _, ok := exists[id]; !ok {
+			missing = append(missing, id)
+		}
+	}
+	return missing, nil
+}
+
+// validateTagIDs はタグIDが全て存在するかを検査する
+func validateTagIDs(ctx context.Context, q sqlx.QueryerContext, tagIDs []int64) error {
+	missing, err := missingTagIDs(ctx, q, tagIDs)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get tags: "+err.Error())
+	}
+	if len(missing) > 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("tags not found: %v", missing))
+	}
+	return nil
+}
+
 // 配信者のテーマ取得API
 // GET /api/user/:username/theme
 func getStreamerThemeHandler(c echo.Context) error {
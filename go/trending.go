@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	// 盛り上がりの減衰の時定数。この時間が経つと過去の投稿の寄与は 1/e になる
+	trendingTimeConstant = 5 * time.Minute
+	// 起動時・初期化時に読み込む投稿の期間 (これより古い投稿の寄与は 0.25% 未満)
+	trendingLoadWindow = 6 * trendingTimeConstant
+	// スコアがこれを下回った配信は集計から外す
+	trendingPruneThreshold = 0.01
+
+	defaultTrendingLimit = 10
+	maxTrendingLimit     = 100
+)
+
+// スコアの重み。チップは金額 100 あたりをコメント1件と同じに扱う
+const (
+	trendingWeightComment  = 1.0
+	trendingWeightReaction = 1.0
+	trendingWeightTip      = 0.01
+)
+
+// 盛り上がりの集計 (コメント・リアクション・チップの投稿ごとに加算される)
+//
+// 各値は投稿ごとに 1 (チップは金額) を加え、時定数 trendingTimeConstant で指数的に減衰させたもので、
+// 時定数で割ると直近の1分あたりの投稿数の推定値になる
+var trending = newTrendingTracker(trendingTimeConstant)
+
+type trendingCounter struct {
+	comments  float64
+	reactions float64
+	tips      float64
+	updatedAt time.Time
+}
+
+// decay は updatedAt から now までの減衰を反映する
+func (c *trendingCounter) decay(now time.Time, tau time.Duration) {
+	if !now.After(c.updatedAt) {
+		return
+	}
+	f := math.Exp(-now.Sub(c.updatedAt).Seconds() / tau.Seconds())
+	c.comments *= f
+	c.reactions *= f
+	c.tips *= f
+	c.updatedAt = now
+}
+
+type trendingTracker struct {
+	mu       sync.Mutex
+	tau      time.Duration
+	counters map[int64]*trendingCounter
+}
+
+func newTrendingTracker(tau time.Duration) *trendingTracker {
+	return &trendingTracker{
+		tau:      tau,
+		counters: make(map[int64]*trendingCounter),
+	}
+}
+
+// add は時刻 at の投稿を加算する。集計済みの時刻より古い投稿はその分だけ減衰させて加える
+func (t *trendingTracker) add(livestreamID int64, at time.Time, comments, reactions, tips float64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	c, ok := t.counters[livestreamID]
+	if !ok {
+		c = &trendingCounter{updatedAt: at}
+		t.counters[livestreamID] = c
+	}
+	c.decay(at, t.tau)
+	f := 1.0
+	if at.Before(c.updatedAt) {
+		f = math.Exp(-c.updatedAt.Sub(at).Seconds() / t.tau.Seconds())
+	}
+	c.comments += comments * f
+	c.reactions += reactions * f
+	c.tips += tips * f
+}
+
+func (t *trendingTracker) recordLivecomment(livestreamID, tip int64, at time.Time) {
+	t.add(livestreamID, at, 1, 0, float64(max(tip, 0)))
+}
+
+func (t *trendingTracker) recordReaction(livestreamID int64, at time.Time) {
+	t.add(livestreamID, at, 0, 1, 0)
+}
+
+func (t *trendingTracker) reset() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.counters = make(map[int64]*trendingCounter)
+}
+
+// TrendingScore は1分あたりの投稿数に換算した盛り上がり
+type TrendingScore struct {
+	LivestreamID       int64   `json:"-"`
+	Score              float64 `json:"score"`
+	CommentsPerMinute  float64 `json:"comments_per_minute"`
+	ReactionsPerMinute float64 `json:"reactions_per_minute"`
+	TipsPerMinute      float64 `json:"tips_per_minute"`
+}
+
+// ranking は now 時点のスコアの高い順に全ての配信を返す。十分に減衰した配信は集計から外す
+func (t *trendingTracker) ranking(now time.Time) []TrendingScore {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	minutes := t.tau.Minutes()
+	scores := make([]TrendingScore, 0, len(t.counters))
+	for livestreamID, c := range t.counters {
+		c.decay(now, t.tau)
+		s := TrendingScore{
+			LivestreamID:       livestreamID,
+			CommentsPerMinute:  c.comments / minutes,
+			ReactionsPerMinute: c.reactions / minutes,
+			TipsPerMinute:      c.tips / minutes,
+		}
+		s.Score = trendingWeightComment*s.CommentsPerMinute + trendingWeightReaction*s.ReactionsPerMinute + trendingWeightTip*s.TipsPerMinute
+		if s.Score < trendingPruneThreshold {
+			delete(t.counters, livestreamID)
+			continue
+		}
+		scores = append(scores, s)
+	}
+
+	sort.Slice(scores, func(i, j int) bool {
+		if scores[i].Score != scores[j].Score {
+			return scores[i].Score > scores[j].Score
+		}
+		return scores[i].LivestreamID > scores[j].LivestreamID
+	})
+	return scores
+}
+
+// loadTrending は直近 trendingLoadWindow の投稿から集計を作り直す
+func loadTrending(ctx context.Context, db *sqlx.DB) error {
+	trending.reset()
+
+	since := time.Now().Add(-trendingLoadWindow).Unix()
+
+	var livecomments []LivecommentModel
+	if err := db.SelectContext(ctx, &livecomments, "SELECT * FROM livecomments WHERE created_at >= ?", since); err != nil {
+		return err
+	}
+	for _, l := range livecomments {
+		trending.recordLivecomment(l.LivestreamID, l.Tip, time.Unix(l.CreatedAt, 0))
+	}
+
+	var reactions []ReactionModel
+	if err := db.SelectContext(ctx, &reactions, "SELECT * FROM reactions WHERE created_at >= ?", since); err != nil {
+		return err
+	}
+	for _, r := range reactions {
+		trending.recordReaction(r.LivestreamID, time.Unix(r.CreatedAt, 0))
+	}
+
+	return nil
+}
+
+type TrendingLivestream struct {
+	Livestream Livestream `json:"livestream"`
+	TrendingScore
+}
+
+// 盛り上がっているライブ配信 (終了した配信は除く)
+// GET /api/livestream/trending?limit=10
+func getTrendingLivestreamsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	limit := defaultTrendingLimit
+	if c.QueryParam("limit") != "" {
+		l, err := strconv.Atoi(c.QueryParam("limit"))
+		if err != nil || l < 1 || l > maxTrendingLimit {
+			return echo.NewHTTPError(http.StatusBadRequest, "limit query parameter must be between 1 and "+strconv.Itoa(maxTrendingLimit))
+		}
+		limit = l
+	}
+
+	now := time.Now()
+	scores := trending.ranking(now)
+
+	resp := []TrendingLivestream{}
+	if len(scores) == 0 {
+		return c.JSON(http.StatusOK, resp)
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	livestreamIDs := make([]int64, len(scores))
+	for i, s := range scores {
+		livestreamIDs[i] = s.LivestreamID
+	}
+	query, args, err := sqlx.In("SELECT * FROM livestreams WHERE id IN (?) AND end_at > ?", livestreamIDs, now.Unix())
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to construct IN query: "+err.Error())
+	}
+	var livestreamModels []LivestreamModel
+	if err := tx.SelectContext(ctx, &livestreamModels, query, args...); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
+	}
+	livestreamModelMap := make(map[int64]LivestreamModel, len(livestreamModels))
+	for _, l := range livestreamModels {
+		livestreamModelMap[l.ID] = l
+	}
+
+	// スコア順に上位 limit 件を選ぶ
+	var (
+		topModels []LivestreamModel
+		topScores []TrendingScore
+	)
+	for _, s := range scores {
+		if len(topModels) >= limit {
+			break
+		}
+		l, ok := livestreamModelMap[s.LivestreamID]
+		if !ok {
+			continue
+		}
+		topModels = append(topModels, l)
+		topScores = append(topScores, s)
+	}
+
+	livestreams, err := fillLivestreamsResponse(ctx, tx, topModels)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestreams: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	for i, l := range livestreams {
+		resp = append(resp, TrendingLivestream{
+			Livestream:    l,
+			TrendingScore: topScores[i],
+		})
+	}
+
+	return c.JSON(http.StatusOK, resp)
+}
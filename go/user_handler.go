@@ -114,6 +114,9 @@ type User struct {
 	Description string `json:"description,omitempty"`
 	Theme       Theme  `json:"theme,omitempty"`
 	IconHash    string `json:"icon_hash,omitempty"`
+	// フォロワー数とフォロー数
+	FollowerCount  int64 `json:"follower_count"`
+	FollowingCount int64 `json:"following_count"`
 }
 
 type Theme struct {
@@ -405,6 +408,9 @@ func registerHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
 	}
 
+	// 検索インデックスに取り込む
+	userIndex.add(userModel)
+
 	return c.JSON(http.StatusCreated, user)
 }
 
@@ -534,6 +540,30 @@ func verifyUserSession(c echo.Context) error {
 	return nil
 }
 
+// viewerUserIDContextKey はリクエストのコンテキストに閲覧中のユーザのIDを格納するキー
+type viewerUserIDContextKey struct{}
+
+// viewerMiddleware は有効なセッションがあれば、そのユーザのIDをリクエストのコンテキストに格納する
+// レスポンスを閲覧者ごとに変える fill 系の関数はコンテキストから閲覧者を参照する
+func viewerMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if err := verifyUserSession(c); err == nil {
+			// error already checked
+			sess, _ := session.Get(defaultSessionIDKey, c)
+			// existence already checked
+			userID := sess.Values[defaultUserIDKey].(int64)
+			c.SetRequest(c.Request().WithContext(context.WithValue(c.Request().Context(), viewerUserIDContextKey{}, userID)))
+		}
+		return next(c)
+	}
+}
+
+// viewerUserID はコンテキストから閲覧中のユーザのIDを取得する。未ログインの場合は false を返す
+func viewerUserID(ctx context.Context) (int64, bool) {
+	userID, ok := ctx.Value(viewerUserIDContextKey{}).(int64)
+	return userID, ok
+}
+
 func fillUserResponse(ctx context.Context, tx *sqlx.Tx, userModel UserModel) (User, error) {
 	users, err := fillUsersResponse(ctx, tx, []UserModel{userModel})
 	if err != nil {
@@ -619,6 +649,12 @@ func fillUsersResponse(ctx context.Context, tx *sqlx.Tx, userModels []UserModel)
 		}
 	}
 
+	// フォロワー数・フォロー数を一括取得
+	followCounts, err := countFollows(ctx, tx, userIDs)
+	if err != nil {
+		return nil, err
+	}
+
 	// User を構築
 	users := make([]User, len(userModels))
 	for i, userModel := range userModels {
@@ -637,7 +673,9 @@ func fillUsersResponse(ctx context.Context, tx *sqlx.Tx, userModels []UserModel)
 				ID:       theme.ID,
 				DarkMode: theme.DarkMode,
 			},
-			IconHash: iconHash,
+			IconHash:       iconHash,
+			FollowerCount:  followCounts.followers[userModel.ID],
+			FollowingCount: followCounts.following[userModel.ID],
 		}
 	}
 
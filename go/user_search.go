@@ -0,0 +1,344 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	defaultUserSearchLimit = 20
+	maxUserSearchLimit     = 100
+
+	// 他のプロセスで登録されたユーザを取り込む間隔
+	userIndexSyncInterval = 10 * time.Second
+	// 同時に登録されたユーザの id がコミット順と前後しても取りこぼさないよう、取り込み済みの最大の id より少し前から読み直す
+	userIndexSyncLookback = 100
+)
+
+// 一致の種類ごとの順位 (小さいほど上位)
+const (
+	userMatchExactName = iota
+	userMatchNamePrefix
+	userMatchDisplayNamePrefix
+	userMatchNameInfix
+	userMatchDisplayNameInfix
+)
+
+// ユーザ検索用のメモリ上のインデックス
+//
+// name と display_name の全ての接尾辞を辞書順に並べて持ち、クエリで始まる接尾辞を二分探索で引く
+// 先頭から始まる接尾辞が前方一致、それ以外が部分一致になる
+// 登録時に追加し、他のプロセスで登録されたユーザは検索時に userIndexSyncInterval ごとに users から取り込む
+// name や display_name を変更する場合は、変更後のユーザを add に渡すと置き換わる
+var userIndex = &userSearchIndex{}
+
+type userIndexEntry struct {
+	id          int64
+	name        string
+	nameLower   string
+	displayName string
+	dispLower   string
+}
+
+// userIndexKey はユーザの name か display_name の接尾辞
+type userIndexKey struct {
+	suffix      string
+	entry       *userIndexEntry
+	displayName bool
+	// 接尾辞の開始位置 (0 なら先頭)
+	pos int
+}
+
+type userSearchIndex struct {
+	mu       sync.RWMutex
+	entries  map[int64]*userIndexEntry
+	keys     []userIndexKey
+	maxID    int64
+	syncedAt time.Time
+}
+
+func newUserIndexEntry(u UserModel) *userIndexEntry {
+	return &userIndexEntry{
+		id:          u.ID,
+		name:        u.Name,
+		nameLower:   strings.ToLower(u.Name),
+		displayName: u.DisplayName,
+		dispLower:   strings.ToLower(u.DisplayName),
+	}
+}
+
+func (e *userIndexEntry) keys() []userIndexKey {
+	var keys []userIndexKey
+	for pos := range e.nameLower {
+		keys = append(keys, userIndexKey{suffix: e.nameLower[pos:], entry: e, pos: pos})
+	}
+	for pos := range e.dispLower {
+		keys = append(keys, userIndexKey{suffix: e.dispLower[pos:], entry: e, displayName: true, pos: pos})
+	}
+	return keys
+}
+
+func userIndexKeyLess(a, b userIndexKey) bool {
+	if a.suffix != b.suffix {
+		return a.suffix < b.suffix
+	}
+	return a.entry.id < b.entry.id
+}
+
+// add はユーザをインデックスに追加する。name や display_name が変わったユーザは置き換える
+func (idx *userSearchIndex) add(users ...UserModel) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	if idx.entries == nil {
+		idx.entries = make(map[int64]*userIndexEntry)
+	}
+	var added []userIndexKey
+	replaced := make(map[int64]struct{})
+	for _, u := range users {
+		if e, ok := idx.entries[u.ID]; ok {
+			if e.name == u.Name && e.displayName == u.DisplayName {
+				continue
+			}
+			replaced[u.ID] = struct{}{}
+		}
+		e := newUserIndexEntry(u)
+		idx.entries[u.ID] = e
+		added = append(added, e.keys()...)
+		idx.maxID = max(idx.maxID, u.ID)
+	}
+	if len(added) == 0 {
+		return
+	}
+
+	current := idx.keys
+	if len(replaced) > 0 {
+		current = make([]userIndexKey, 0, len(idx.keys))
+		for _, k := range idx.keys {
+			if _, ok := replaced[k.entry.id]; !ok {
+				current = append(current, k)
+			}
+		}
+	}
+	sort.Slice(added, func(i, j int) bool { return userIndexKeyLess(added[i], added[j]) })
+
+	// 並べ済みの既存の接尾辞と追加分をマージする
+	keys := make([]userIndexKey, 0, len(current)+len(added))
+	i, j := 0, 0
+	for i < len(current) && j < len(added) {
+		if userIndexKeyLess(added[j], current[i]) {
+			keys = append(keys, added[j])
+			j++
+		} else {
+			keys = append(keys, current[i])
+			i++
+		}
+	}
+	keys = append(keys, current[i:]...)
+	keys = append(keys, added[j:]...)
+	idx.keys = keys
+}
+
+func (idx *userSearchIndex) reset() {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	idx.entries = nil
+	idx.keys = nil
+	idx.maxID = 0
+	idx.syncedAt = time.Time{}
+}
+
+// sync はインデックスに取り込んでいないユーザを users から取り込む
+func (idx *userSearchIndex) sync(ctx context.Context, db *sqlx.DB, now time.Time) error {
+	idx.mu.RLock()
+	since := idx.maxID - userIndexSyncLookback
+	idx.mu.RUnlock()
+
+	var userModels []UserModel
+	if err := db.SelectContext(ctx, &userModels, "SELECT id, name, display_name FROM users WHERE id > ? ORDER BY id", since); err != nil {
+		return err
+	}
+	idx.add(userModels...)
+
+	idx.mu.Lock()
+	idx.syncedAt = now
+	idx.mu.Unlock()
+	return nil
+}
+
+// syncIfStale は前回の取り込みから userIndexSyncInterval 以上経っていれば取り込む
+func (idx *userSearchIndex) syncIfStale(ctx context.Context, db *sqlx.DB, now time.Time) error {
+	idx.mu.RLock()
+	stale := now.Sub(idx.syncedAt) >= userIndexSyncInterval
+	idx.mu.RUnlock()
+	if !stale {
+		return nil
+	}
+	return idx.sync(ctx, db, now)
+}
+
+type userSearchHit struct {
+	id    int64
+	name  string
+	match int
+}
+
+// search は name と display_name に対する前方一致・部分一致で検索し、順位順に並べた user_id を返す
+// 同じ順位の場合は名前の短い順、名前順に並べる
+func (idx *userSearchIndex) search(q string, offset, limit int) ([]int64, int) {
+	q = strings.ToLower(q)
+
+	idx.mu.RLock()
+	best := make(map[int64]userSearchHit)
+	for i := sort.Search(len(idx.keys), func(i int) bool { return idx.keys[i].suffix >= q }); i < len(idx.keys) && strings.HasPrefix(idx.keys[i].suffix, q); i++ {
+		k := idx.keys[i]
+		var match int
+		switch {
+		case !k.displayName && k.pos == 0 && k.suffix == q:
+			match = userMatchExactName
+		case !k.displayName && k.pos == 0:
+			match = userMatchNamePrefix
+		case k.pos == 0:
+			match = userMatchDisplayNamePrefix
+		case !k.displayName:
+			match = userMatchNameInfix
+		default:
+			match = userMatchDisplayNameInfix
+		}
+		if hit, ok := best[k.entry.id]; !ok || match < hit.match {
+			best[k.entry.id] = userSearchHit{id: k.entry.id, name: k.entry.name, match: match}
+		}
+	}
+	idx.mu.RUnlock()
+
+	hits := make([]userSearchHit, 0, len(best))
+	for _, h := range best {
+		hits = append(hits, h)
+	}
+	sort.Slice(hits, func(i, j int) bool {
+		if hits[i].match != hits[j].match {
+			return hits[i].match < hits[j].match
+		}
+		if len(hits[i].name) != len(hits[j].name) {
+			return len(hits[i].name) < len(hits[j].name)
+		}
+		return hits[i].name < hits[j].name
+	})
+
+	total := len(hits)
+	if offset >= total {
+		return []int64{}, total
+	}
+	hits = hits[offset:min(offset+limit, total)]
+	userIDs := make([]int64, len(hits))
+	for i, h := range hits {
+		userIDs[i] = h.id
+	}
+	return userIDs, total
+}
+
+// loadUserIndex はインデックスを users の内容で作り直す
+func loadUserIndex(ctx context.Context, db *sqlx.DB) error {
+	userIndex.reset()
+	return userIndex.sync(ctx, db, time.Now())
+}
+
+type UserSearchResponse struct {
+	Users []User `json:"users"`
+	Total int    `json:"total"`
+	// 次のページの offset。続きがなければ省略する
+	NextOffset *int `json:"next_offset,omitempty"`
+}
+
+// ユーザ検索API (共同配信者やメンションの入力補完用)
+// GET /api/user/search?q=&limit=20&offset=0
+func searchUsersHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	q := strings.TrimSpace(c.QueryParam("q"))
+	if q == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "q query parameter is required")
+	}
+
+	limit := defaultUserSearchLimit
+	if c.QueryParam("limit") != "" {
+		l, err := strconv.Atoi(c.QueryParam("limit"))
+		if err != nil || l < 1 || l > maxUserSearchLimit {
+			return echo.NewHTTPError(http.StatusBadRequest, "limit query parameter must be between 1 and "+strconv.Itoa(maxUserSearchLimit))
+		}
+		limit = l
+	}
+	offset := 0
+	if c.QueryParam("offset") != "" {
+		o, err := strconv.Atoi(c.QueryParam("offset"))
+		if err != nil || o < 0 {
+			return echo.NewHTTPError(http.StatusBadRequest, "offset query parameter must be non-negative integer")
+		}
+		offset = o
+	}
+
+	if err := userIndex.syncIfStale(ctx, dbConn, time.Now()); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to sync user index: "+err.Error())
+	}
+	userIDs, total := userIndex.search(q, offset, limit)
+
+	resp := UserSearchResponse{
+		Users: []User{},
+		Total: total,
+	}
+	if next := offset + len(userIDs); next < total {
+		resp.NextOffset = &next
+	}
+	if len(userIDs) == 0 {
+		return c.JSON(http.StatusOK, resp)
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	query, args, err := sqlx.In("SELECT * FROM users WHERE id IN (?)", userIDs)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to construct IN query: "+err.Error())
+	}
+	var userModels []UserModel
+	if err := tx.SelectContext(ctx, &userModels, query, args...); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get users: "+err.Error())
+	}
+	users, err := fillUsersResponse(ctx, tx, userModels)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill users: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	// 検索順位の順に並べ直す
+	userMap := make(map[int64]User, len(users))
+	for i, u := range userModels {
+		userMap[u.ID] = users[i]
+	}
+	for _, id := range userIDs {
+		if u, ok := userMap[id]; ok {
+			resp.Users = append(resp.Users, u)
+		}
+	}
+
+	return c.JSON(http.StatusOK, resp)
+}
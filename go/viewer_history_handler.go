@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	defaultViewerHistoryLimit = 20
+	maxViewerHistoryLimit     = 100
+)
+
+// viewerHistoryRow はユーザがライブ配信ごとに視聴した履歴の集計
+type viewerHistoryRow struct {
+	LivestreamModel
+	LastWatchedAt int64 `db:"last_watched_at"`
+	WatchSeconds  int64 `db:"watch_seconds"`
+}
+
+type ViewerHistory struct {
+	Livestream Livestream `json:"livestream"`
+	// 最後に入室した時刻
+	LastWatchedAt int64 `json:"last_watched_at"`
+	// 合計視聴時間 (秒)
+	WatchSeconds int64 `json:"watch_seconds"`
+}
+
+// 視聴したライブ配信の履歴 (最後に視聴した順)
+// GET /api/user/me/history?limit=20&cursor=
+//
+// 視聴時間は入室から退室までの合計で、退室していない視聴は現在時刻か配信の終了時刻までとして数える
+// 続きがあれば次のページのカーソルを X-Next-Cursor ヘッダで返す
+func getViewerHistoryHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	limit := defaultViewerHistoryLimit
+	if c.QueryParam("limit") != "" {
+		l, err := strconv.Atoi(c.QueryParam("limit"))
+		if err != nil || l < 1 || l > maxViewerHistoryLimit {
+			return echo.NewHTTPError(http.StatusBadRequest, "limit query parameter must be between 1 and "+strconv.Itoa(maxViewerHistoryLimit))
+		}
+		limit = l
+	}
+
+	query := `SELECT l.*,
+		MAX(h.created_at) AS last_watched_at,
+		SUM(GREATEST(IF(h.exited_at = 0, LEAST(?, l.end_at), h.exited_at) - h.created_at, 0)) AS watch_seconds
+		FROM livestream_viewers_history h
+		INNER JOIN livestreams l ON l.id = h.livestream_id
+		WHERE h.user_id = ?
+		GROUP BY l.id`
+	args := []interface{}{time.Now().Unix(), userID}
+	if c.QueryParam("cursor") != "" {
+		cursor, err := decodeLivestreamSearchCursor(c.QueryParam("cursor"))
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "cursor query parameter is malformed")
+		}
+		query += " HAVING (last_watched_at < ? OR (last_watched_at = ? AND l.id < ?))"
+		args = append(args, cursor.Key, cursor.Key, cursor.ID)
+	}
+	// 続きがあるかを判定するため1件多く取得する
+	query += fmt.Sprintf(" ORDER BY last_watched_at DESC, l.id DESC LIMIT %d", limit+1)
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	var rows []viewerHistoryRow
+	if err := tx.SelectContext(ctx, &rows, query, args...); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get viewer history: "+err.Error())
+	}
+	if len(rows) > limit {
+		rows = rows[:limit]
+		last := rows[len(rows)-1]
+		c.Response().Header().Set(nextCursorHeader, livestreamSearchCursor{Key: last.LastWatchedAt, ID: last.ID}.encode())
+	}
+
+	livestreamModels := make([]LivestreamModel, len(rows))
+	for i, row := range rows {
+		livestreamModels[i] = row.LivestreamModel
+	}
+	livestreams, err := fillLivestreamsResponse(ctx, tx, livestreamModels)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestreams: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	history := make([]ViewerHistory, len(rows))
+	for i, row := range rows {
+		history[i] = ViewerHistory{
+			Livestream:    livestreams[i],
+			LastWatchedAt: row.LastWatchedAt,
+			WatchSeconds:  row.WatchSeconds,
+		}
+	}
+
+	return c.JSON(http.StatusOK, history)
+}
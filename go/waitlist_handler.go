@@ -0,0 +1,385 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	waitlistStatusWaiting   = "waiting"
+	waitlistStatusFulfilled = "fulfilled"
+	waitlistStatusCancelled = "cancelled"
+	// 予約への切り替えに失敗した (タグが削除された場合など)
+	waitlistStatusFailed = "failed"
+	// 予約に切り替わらないまま予約区間の開始時刻を過ぎた
+	waitlistStatusExpired = "expired"
+)
+
+type ReservationWaitlistModel struct {
+	ID            int64  `db:"id"`
+	UserID        int64  `db:"user_id"`
+	Title         string `db:"title"`
+	Description   string `db:"description"`
+	PlaylistUrl   string `db:"playlist_url"`
+	ThumbnailUrl  string `db:"thumbnail_url"`
+	Tags          string `db:"tags"`
+	Collaborators string `db:"collaborators"`
+	StartAt       int64  `db:"start_at"`
+	EndAt         int64  `db:"end_at"`
+	Status        string `db:"status"`
+	LivestreamID  int64  `db:"livestream_id"`
+	CreatedAt     int64  `db:"created_at"`
+	UpdatedAt     int64  `db:"updated_at"`
+}
+
+type ReservationWaitlistEntry struct {
+	ID            int64    `json:"id"`
+	Title         string   `json:"title"`
+	Description   string   `json:"description"`
+	PlaylistUrl   string   `json:"playlist_url"`
+	ThumbnailUrl  string   `json:"thumbnail_url"`
+	Tags          []int64  `json:"tags"`
+	Collaborators []string `json:"collaborators"`
+	StartAt       int64    `json:"start_at"`
+	EndAt         int64    `json:"end_at"`
+	Status        string   `json:"status"`
+	LivestreamID  int64    `json:"livestream_id,omitempty"`
+	CreatedAt     int64    `json:"created_at"`
+}
+
+func (m ReservationWaitlistModel) reserveRequest() (*ReserveLivestreamRequest, error) {
+	req := &ReserveLivestreamRequest{
+		Title:        m.Title,
+		Description:  m.Description,
+		PlaylistUrl:  m.PlaylistUrl,
+		ThumbnailUrl: m.ThumbnailUrl,
+		StartAt:      m.StartAt,
+		EndAt:        m.EndAt,
+	}
+	if err := json.Unmarshal([]byte(m.Tags), &req.Tags); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(m.Collaborators), &req.Collaborators); err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+func toReservationWaitlistEntry(m ReservationWaitlistModel) (ReservationWaitlistEntry, error) {
+	req, err := m.reserveRequest()
+	if err != nil {
+		return ReservationWaitlistEntry{}, err
+	}
+	tags := req.Tags
+	if tags == nil {
+		tags = []int64{}
+	}
+	collaborators := req.Collaborators
+	if collaborators == nil {
+		collaborators = []string{}
+	}
+	return ReservationWaitlistEntry{
+		ID:            m.ID,
+		Title:         m.Title,
+		Description:   m.Description,
+		PlaylistUrl:   m.PlaylistUrl,
+		ThumbnailUrl:  m.ThumbnailUrl,
+		Tags:          tags,
+		Collaborators: collaborators,
+		StartAt:       m.StartAt,
+		EndAt:         m.EndAt,
+		Status:        m.Status,
+		LivestreamID:  m.LivestreamID,
+		CreatedAt:     m.CreatedAt,
+	}, nil
+}
+
+// キャンセル待ち登録API
+// 予約枠に空きが出た時点で、登録順に予約へ切り替わる
+// POST /api/livestream/reservation/waitlist
+func joinReservationWaitlistHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	var req *ReserveLivestreamRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+
+	if err := validateReservationTerm(req.StartAt, req.EndAt); err != nil {
+		return err
+	}
+	if err := validateTagIDs(ctx, dbConn, req.Tags); err != nil {
+		return err
+	}
+	if _, err := resolveCollaborators(ctx, dbConn, userID, req.Collaborators); err != nil {
+		return err
+	}
+	if err := checkReservationPolicy(ctx, dbConn, userID, []reservationRange{{startAt: req.StartAt, endAt: req.EndAt}}, time.Now()); err != nil {
+		return err
+	}
+
+	// 空きがあるならキャンセル待ちではなく予約してもらう
+	full := false
+	for _, slot := range slotAlloc.slotsIn(req.StartAt, req.EndAt) {
+		if slot.remaining.Load() < 1 {
+			full = true
+			break
+		}
+	}
+	if !full {
+		return echo.NewHTTPError(http.StatusBadRequest, "the reservation time range is available; reserve it directly")
+	}
+
+	tags, err := json.Marshal(req.Tags)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to encode tags: "+err.Error())
+	}
+	collaborators, err := json.Marshal(req.Collaborators)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to encode collaborators: "+err.Error())
+	}
+
+	now := time.Now().Unix()
+	waitlistModel := ReservationWaitlistModel{
+		UserID:        userID,
+		Title:         req.Title,
+		Description:   req.Description,
+		PlaylistUrl:   req.PlaylistUrl,
+		ThumbnailUrl:  req.ThumbnailUrl,
+		Tags:          string(tags),
+		Collaborators: string(collaborators),
+		StartAt:       req.StartAt,
+		EndAt:         req.EndAt,
+		Status:        waitlistStatusWaiting,
+		CreatedAt:     now,
+		UpdatedAt:     now,
+	}
+	rs, err := dbConn.NamedExecContext(ctx, "INSERT INTO reservation_waitlist (user_id, title, description, playlist_url, thumbnail_url, tags, collaborators, start_at, end_at, status, created_at, updated_at) VALUES (:user_id, :title, :description, :playlist_url, :thumbnail_url, :tags, :collaborators, :start_at, :end_at, :status, :created_at, :updated_at)", &waitlistModel)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert reservation waitlist: "+err.Error())
+	}
+	waitlistID, err := rs.LastInsertId()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get last inserted reservation waitlist id: "+err.Error())
+	}
+	waitlistModel.ID = waitlistID
+
+	entry, err := toReservationWaitlistEntry(waitlistModel)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill reservation waitlist: "+err.Error())
+	}
+
+	return c.JSON(http.StatusCreated, entry)
+}
+
+// キャンセル待ち一覧取得API
+// GET /api/livestream/reservation/waitlist
+func getReservationWaitlistHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	if err := expireReservationWaitlist(ctx, time.Now()); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to expire reservation waitlist: "+err.Error())
+	}
+
+	var waitlistModels []ReservationWaitlistModel
+	if err := dbConn.SelectContext(ctx, &waitlistModels, "SELECT * FROM reservation_waitlist WHERE user_id = ? ORDER BY id DESC", userID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get reservation waitlist: "+err.Error())
+	}
+
+	entries := make([]ReservationWaitlistEntry, len(waitlistModels))
+	for i, m := range waitlistModels {
+		entry, err := toReservationWaitlistEntry(m)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill reservation waitlist: "+err.Error())
+		}
+		entries[i] = entry
+	}
+
+	return c.JSON(http.StatusOK, entries)
+}
+
+// キャンセル待ち取り消しAPI
+// DELETE /api/livestream/reservation/waitlist/:waitlist_id
+func leaveReservationWaitlistHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	waitlistID, err := strconv.Atoi(c.Param("waitlist_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "waitlist_id in path must be integer")
+	}
+
+	rs, err := dbConn.ExecContext(ctx, "UPDATE reservation_waitlist SET status = ?, updated_at = ? WHERE id = ? AND user_id = ? AND status = ?", waitlistStatusCancelled, time.Now().Unix(), waitlistID, userID, waitlistStatusWaiting)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to cancel reservation waitlist: "+err.Error())
+	}
+	if n, err := rs.RowsAffected(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get affected rows: "+err.Error())
+	} else if n == 0 {
+		return echo.NewHTTPError(http.StatusNotFound, "waiting reservation waitlist not found")
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// processReservationWaitlist は空きが出た区間と重なるキャンセル待ちを登録順に予約へ切り替える
+// 予約枠を更新したトランザクションのコミット後に呼ぶ
+// 検証や予約ポリシーで切り替えられないキャンセル待ちは failed にし、DB のエラーなど一時的な失敗は waiting のまま残す
+// いずれの場合も後続の処理を続け、失敗はまとめて返す
+func processReservationWaitlist(ctx context.Context, startAt, endAt int64) error {
+	now := time.Now()
+	if err := expireReservationWaitlist(ctx, now); err != nil {
+		return err
+	}
+
+	var waitlistIDs []int64
+	if err := dbConn.SelectContext(ctx, &waitlistIDs, "SELECT id FROM reservation_waitlist WHERE status = ? AND start_at < ? AND end_at > ? AND start_at > ? ORDER BY created_at, id", waitlistStatusWaiting, endAt, startAt, now.Unix()); err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, waitlistID := range waitlistIDs {
+		if _, err := fulfillReservationWaitlist(ctx, waitlistID); err != nil {
+			errs = append(errs, fmt.Errorf("reservation waitlist %d: %w", waitlistID, err))
+			if !isWaitlistUnfulfillable(err) {
+				continue
+			}
+			if _, err := dbConn.ExecContext(ctx, "UPDATE reservation_waitlist SET status = ?, updated_at = ? WHERE id = ? AND status = ?", waitlistStatusFailed, time.Now().Unix(), waitlistID, waitlistStatusWaiting); err != nil {
+				errs = append(errs, fmt.Errorf("failed to mark reservation waitlist %d as failed: %w", waitlistID, err))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// expireReservationWaitlist は予約区間の開始時刻を過ぎたキャンセル待ちを expired にする
+// 予約ポリシーを満たさないまま待ち続けているキャンセル待ちもここで打ち切られる
+func expireReservationWaitlist(ctx context.Context, now time.Time) error {
+	_, err := dbConn.ExecContext(ctx, "UPDATE reservation_waitlist SET status = ?, updated_at = ? WHERE status = ? AND start_at <= ?", waitlistStatusExpired, now.Unix(), waitlistStatusWaiting, now.Unix())
+	return err
+}
+
+// isWaitlistUnfulfillable はキャンセル待ちを予約に切り替えられないことが確定したエラーかを判定する
+// 検証や予約ポリシーによる 4xx のエラーが該当し、DB のエラーなど 5xx のエラーは該当しない
+func isWaitlistUnfulfillable(err error) bool {
+	var he *echo.HTTPError
+	return errors.As(err, &he) && he.Code < http.StatusInternalServerError
+}
+
+// fulfillReservationWaitlist はキャンセル待ちを予約に切り替え、配信者に通知する
+// 予約枠がまだ空いていなければ false を返す
+func fulfillReservationWaitlist(ctx context.Context, waitlistID int64) (bool, error) {
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	var waitlistModel ReservationWaitlistModel
+	if err := tx.GetContext(ctx, &waitlistModel, "SELECT * FROM reservation_waitlist WHERE id = ? AND status = ? FOR UPDATE", waitlistID, waitlistStatusWaiting); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	// 処理までの間に開始時刻を過ぎていれば予約せずに打ち切る
+	now := time.Now()
+	if waitlistModel.StartAt <= now.Unix() {
+		if _, err := tx.ExecContext(ctx, "UPDATE reservation_waitlist SET status = ?, updated_at = ? WHERE id = ?", waitlistStatusExpired, now.Unix(), waitlistModel.ID); err != nil {
+			return false, err
+		}
+		return false, tx.Commit()
+	}
+
+	req, err := waitlistModel.reserveRequest()
+	if err != nil {
+		return false, err
+	}
+
+	// 予約期間が変わって予約区間が外れていれば予約できない
+	if err := validateReservationTerm(req.StartAt, req.EndAt); err != nil {
+		return false, err
+	}
+	// 登録後にタグが削除・統合されていれば予約できない
+	if err := validateTagIDs(ctx, tx, req.Tags); err != nil {
+		return false, err
+	}
+
+	// 予約ポリシーを満たさなくなっていれば、満たすようになるか開始時刻を過ぎるまで待たせておく
+	if err := lockUserForReservation(ctx, tx, waitlistModel.UserID); err != nil {
+		return false, err
+	}
+	if err := checkReservationPolicy(ctx, tx, waitlistModel.UserID, []reservationRange{{startAt: req.StartAt, endAt: req.EndAt}}, now); err != nil {
+		if errors.Is(err, errReservationPolicyViolated) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	sr := newSlotReservation()
+	defer sr.Rollback()
+	if err := acquireReservationSlots(ctx, tx, sr, req.StartAt, req.EndAt); err != nil {
+		if isReservationUnavailable(err) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	livestreamModel, err := insertReservedLivestream(ctx, tx, waitlistModel.UserID, req)
+	if err != nil {
+		return false, err
+	}
+
+	if _, err := tx.ExecContext(ctx, "UPDATE reservation_waitlist SET status = ?, livestream_id = ?, updated_at = ? WHERE id = ?", waitlistStatusFulfilled, livestreamModel.ID, now.Unix(), waitlistModel.ID); err != nil {
+		return false, err
+	}
+
+	message := fmt.Sprintf("キャンセル待ちしていた予約区間 %d ~ %d の予約が確定しました", req.StartAt, req.EndAt)
+	if err := insertNotification(ctx, tx, waitlistModel.UserID, notificationKindWaitlistFulfilled, message, livestreamModel.ID); err != nil {
+		return false, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return false, err
+	}
+	sr.Commit()
+
+	return true, nil
+}
@@ -8,6 +8,16 @@ TRUNCATE TABLE reactions;
 TRUNCATE TABLE tags;
 TRUNCATE TABLE livestream_tags;
 TRUNCATE TABLE livecomments;
+TRUNCATE TABLE tip_ledger;
+TRUNCATE TABLE payment_charges;
+TRUNCATE TABLE reservation_waitlist;
+TRUNCATE TABLE notifications;
+TRUNCATE TABLE livestream_series;
+TRUNCATE TABLE livestream_series_members;
+TRUNCATE TABLE livestream_collaborators;
+TRUNCATE TABLE tag_aliases;
+TRUNCATE TABLE follows;
+TRUNCATE TABLE bookmarks;
 TRUNCATE TABLE livestreams;
 TRUNCATE TABLE users;
 
@@ -21,5 +31,15 @@ ALTER TABLE `ng_words` auto_increment = 1;
 ALTER TABLE `reactions` auto_increment = 1;
 ALTER TABLE `tags` auto_increment = 1;
 ALTER TABLE `livecomments` auto_increment = 1;
+ALTER TABLE `tip_ledger` auto_increment = 1;
+ALTER TABLE `payment_charges` auto_increment = 1;
+ALTER TABLE `reservation_waitlist` auto_increment = 1;
+ALTER TABLE `notifications` auto_increment = 1;
+ALTER TABLE `livestream_series` auto_increment = 1;
+ALTER TABLE `livestream_series_members` auto_increment = 1;
+ALTER TABLE `livestream_collaborators` auto_increment = 1;
+ALTER TABLE `tag_aliases` auto_increment = 1;
+ALTER TABLE `follows` auto_increment = 1;
+ALTER TABLE `bookmarks` auto_increment = 1;
 ALTER TABLE `livestreams` auto_increment = 1;
 ALTER TABLE `users` auto_increment = 1;
\ No newline at end of file
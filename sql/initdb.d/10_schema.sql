@@ -33,7 +33,9 @@ CREATE TABLE `livestreams` (
   `playlist_url` VARCHAR(255) NOT NULL,
   `thumbnail_url` VARCHAR(255) NOT NULL,
   `start_at` BIGINT NOT NULL,
-  `end_at` BIGINT NOT NULL
+  `end_at` BIGINT NOT NULL,
+  -- 最大同時視聴者数
+  `peak_viewers` BIGINT NOT NULL DEFAULT 0
 ) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
 
 -- ライブ配信予約枠
@@ -63,7 +65,11 @@ CREATE TABLE `livestream_viewers_history` (
   `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
   `user_id` BIGINT NOT NULL,
   `livestream_id` BIGINT NOT NULL,
-  `created_at` BIGINT NOT NULL
+  `created_at` BIGINT NOT NULL,
+  -- 退室した時刻 (視聴中は 0)
+  `exited_at` BIGINT NOT NULL DEFAULT 0,
+  INDEX `livestream_viewers_history_user_id` (`user_id`),
+  INDEX `livestream_viewers_history_livestream_id` (`livestream_id`, `exited_at`)
 ) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
 
 -- ライブ配信に対するライブコメント
@@ -103,4 +109,132 @@ CREATE TABLE `reactions` (
   -- :innocent:, :tada:, etc...
   `emoji_name` VARCHAR(255) NOT NULL,
   `created_at` BIGINT NOT NULL
-) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
\ No newline at end of file
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- ライブコメントに付随するチップの台帳 (返金は負の金額で記録する)
+CREATE TABLE `tip_ledger` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `livecomment_id` BIGINT NOT NULL,
+  `user_id` BIGINT NOT NULL,
+  `livestream_id` BIGINT NOT NULL,
+  -- tip, refund
+  `kind` VARCHAR(32) NOT NULL,
+  `amount` BIGINT NOT NULL,
+  `created_at` BIGINT NOT NULL
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+CREATE INDEX tip_ledger_livestream_id ON tip_ledger(`livestream_id`);
+CREATE INDEX tip_ledger_livecomment_id ON tip_ledger(`livecomment_id`);
+
+-- 決済代行サービス経由のチップ課金
+CREATE TABLE `payment_charges` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  -- アプリケーション側で採番し、決済代行サービスの webhook で返ってくる参照ID
+  `reference` VARCHAR(255) NOT NULL,
+  `provider_charge_id` VARCHAR(255) NOT NULL DEFAULT '',
+  `user_id` BIGINT NOT NULL,
+  `livestream_id` BIGINT NOT NULL,
+  `comment` VARCHAR(255) NOT NULL,
+  `amount` BIGINT NOT NULL,
+  -- pending, succeeded, failed, refunded
+  `status` VARCHAR(32) NOT NULL,
+  -- 決済成功時に作成されたライブコメント
+  `livecomment_id` BIGINT NOT NULL DEFAULT 0,
+  `created_at` BIGINT NOT NULL,
+  `updated_at` BIGINT NOT NULL,
+  UNIQUE `uniq_payment_charge_reference` (`reference`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- 満席の予約区間に対するキャンセル待ち
+CREATE TABLE `reservation_waitlist` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `user_id` BIGINT NOT NULL,
+  `title` VARCHAR(255) NOT NULL,
+  `description` TEXT NOT NULL,
+  `playlist_url` VARCHAR(255) NOT NULL,
+  `thumbnail_url` VARCHAR(255) NOT NULL,
+  -- タグIDのJSON配列
+  `tags` TEXT NOT NULL,
+  -- 共同配信者のユーザ名のJSON配列
+  `collaborators` TEXT NOT NULL,
+  `start_at` BIGINT NOT NULL,
+  `end_at` BIGINT NOT NULL,
+  -- waiting, fulfilled, cancelled, failed, expired
+  `status` VARCHAR(32) NOT NULL,
+  -- 予約に切り替わった際に作成されたライブ配信
+  `livestream_id` BIGINT NOT NULL DEFAULT 0,
+  `created_at` BIGINT NOT NULL,
+  `updated_at` BIGINT NOT NULL
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+CREATE INDEX reservation_waitlist_status_start_at ON reservation_waitlist(`status`, `start_at`);
+
+-- ユーザへの通知
+CREATE TABLE `notifications` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `user_id` BIGINT NOT NULL,
+  `kind` VARCHAR(64) NOT NULL,
+  `message` TEXT NOT NULL,
+  `livestream_id` BIGINT NOT NULL DEFAULT 0,
+  `created_at` BIGINT NOT NULL
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+CREATE INDEX notifications_user_id ON notifications(`user_id`, `created_at`);
+
+-- 繰り返し予約の系列
+CREATE TABLE `livestream_series` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `user_id` BIGINT NOT NULL,
+  -- daily, weekly
+  `frequency` VARCHAR(32) NOT NULL,
+  `interval_count` BIGINT NOT NULL,
+  `occurrences` BIGINT NOT NULL,
+  `created_at` BIGINT NOT NULL
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- 系列に属するライブ配信
+CREATE TABLE `livestream_series_members` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `series_id` BIGINT NOT NULL,
+  `livestream_id` BIGINT NOT NULL,
+  UNIQUE `uniq_livestream_series_member` (`livestream_id`),
+  INDEX `livestream_series_members_series_id` (`series_id`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- ライブ配信の共同配信者 (招待された側が承諾すると配信に表示される)
+CREATE TABLE `livestream_collaborators` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `livestream_id` BIGINT NOT NULL,
+  `user_id` BIGINT NOT NULL,
+  -- pending, accepted, declined
+  `status` VARCHAR(32) NOT NULL,
+  `created_at` BIGINT NOT NULL,
+  `updated_at` BIGINT NOT NULL,
+  UNIQUE `uniq_livestream_collaborator` (`livestream_id`, `user_id`),
+  INDEX `livestream_collaborators_user_id_status` (`user_id`, `status`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- タグの別名 (検索時に正規のタグに解決する)
+CREATE TABLE `tag_aliases` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `tag_id` BIGINT NOT NULL,
+  `name` VARCHAR(255) NOT NULL,
+  UNIQUE `uniq_tag_alias_name` (`name`),
+  INDEX `tag_aliases_tag_id` (`tag_id`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- ユーザのフォロー関係
+CREATE TABLE `follows` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `follower_id` BIGINT NOT NULL,
+  `followee_id` BIGINT NOT NULL,
+  `created_at` BIGINT NOT NULL,
+  UNIQUE `uniq_follow` (`follower_id`, `followee_id`),
+  INDEX `follows_followee_id` (`followee_id`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- ライブ配信のブックマーク (あとで見る)
+CREATE TABLE `bookmarks` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `user_id` BIGINT NOT NULL,
+  `livestream_id` BIGINT NOT NULL,
+  `created_at` BIGINT NOT NULL,
+  UNIQUE `uniq_bookmark` (`user_id`, `livestream_id`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
@@ -0,0 +1,4 @@
+INSERT INTO tip_ledger (livecomment_id, user_id, livestream_id, kind, amount, created_at)
+SELECT id, user_id, livestream_id, 'tip', tip, created_at
+FROM livecomments
+WHERE tip > 0;